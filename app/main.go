@@ -3,85 +3,309 @@ package main
 import (
 	"context"
 	"flag"
+	"github.com/blackHATred/mitm_proxy/internal/config"
 	"github.com/blackHATred/mitm_proxy/internal/delivery"
+	"github.com/blackHATred/mitm_proxy/internal/logging"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
 	mongoRepo "github.com/blackHATred/mitm_proxy/internal/repository/mongo"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
 	"github.com/blackHATred/mitm_proxy/internal/usecase/service"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 )
 
 func main() {
-	var proxyURI = flag.String("proxy", ":8000", "Ссылка для подключения к прокси")
-	var mongoURI = flag.String("db", "mongodb://localhost:27017", "Ссылка для подключения к Mongo")
-	var webAddr = flag.String("web", ":8080", "Адрес web-интерфейса")
-	var caKeyFilename = flag.String("ca-key", "ca.key", "Путь до корневого самоподписанного сертификата")
-	var caCertFilename = flag.String("ca-cert", "ca.crt", "Путь до корневого самоподписанного сертификата для клиентов")
+	loader := config.NewLoader(flag.CommandLine)
 	flag.Parse()
+	cfg, err := loader.Load()
+	if err != nil {
+		fatal("Ошибка загрузки конфигурации", err)
+	}
+	// уровень логирования меняется при перезагрузке конфигурации, формат - только при перезапуске
+	logLevel := &slog.LevelVar{}
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logLevel.Set(level)
+	slog.SetDefault(logging.New(os.Stderr, logLevel, cfg.Log.JSON))
+	timeouts := cfg.Timeouts.Entity()
+	delivery.SetTemplatesDir(cfg.Web.Templates)
+	metrics.SetHosts(cfg.Metrics.Hosts)
 
+	// счётчик уменьшается, когда слушатель (прокси или веб-сервер) полностью остановлен
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
-	clientOptions := options.Client().ApplyURI(*mongoURI)
+	clientOptions := options.Client().ApplyURI(cfg.Storage.MongoURI)
 	db, err := mongo.Connect(context.Background(), clientOptions)
 	if err != nil {
-		log.Fatalf("Ошибка подключения к MongoDB: %v", err)
+		fatal("Ошибка подключения к MongoDB", err)
 	}
 	err = db.Ping(context.Background(), nil)
 	if err != nil {
-		log.Fatalf("Не удалось подключиться к MongoDB: %v", err)
+		fatal("Не удалось подключиться к MongoDB", err)
 	}
 
-	historyRepo, err := mongoRepo.NewHistoryRepository(db.Database("proxyDB"), *caKeyFilename, *caCertFilename)
+	historyRepo, err := mongoRepo.NewHistoryRepository(db.Database(cfg.Storage.Database), cfg.CA.Key, cfg.CA.Cert)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	scopeUC, err := service.NewScopeUsecase(cfg.Scope.Entity(), cfg.Scope.File)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	upstreamUC, err := service.NewUpstreamUsecase(cfg.Upstream.Entity(), timeouts)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	findingRepo := mongoRepo.NewFindingRepository(db.Database(cfg.Storage.Database))
+	liveUC := service.NewLiveUsecase()
+	scannerUC := service.NewScannerUsecase(historyRepo, findingRepo, scopeUC, upstreamUC, liveUC)
+	historyUC, err := service.NewHistoryUsecase(historyRepo, scannerUC, scopeUC, upstreamUC, liveUC, cfg.Scanner.ParamsFile)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	scannerUC.SetHistoryUsecase(historyUC)
+	historyDelivery, err := delivery.NewHistoryDelivery(historyUC, scannerUC, scopeUC)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	findingDelivery, err := delivery.NewFindingDelivery(service.NewFindingUsecase(findingRepo))
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	rewriteUC, err := service.NewRewriteUsecase(cfg.Rewrite.Entity(), cfg.Rewrite.RulesFile)
 	if err != nil {
-		log.Fatalf("Произошла ошибка при инициализации: %v", err)
+		fatal("Произошла ошибка при инициализации", err)
 	}
-	historyUC, err := service.NewHistoryUsecase(historyRepo, "resources/params.txt")
+	ruleDelivery, err := delivery.NewRuleDelivery(rewriteUC)
 	if err != nil {
-		log.Fatalf("Произошла ошибка при инициализации: %v", err)
+		fatal("Произошла ошибка при инициализации", err)
 	}
-	historyDelivery, err := delivery.NewHistoryDelivery(historyUC)
+	passthroughUC := service.NewPassthroughUsecase(cfg.Passthrough.Hosts, cfg.Passthrough.After)
+	interceptUC := service.NewInterceptUsecase(cfg.Intercept.Timeout)
+	interceptDelivery, err := delivery.NewInterceptDelivery(interceptUC)
 	if err != nil {
-		log.Fatalf("Произошла ошибка при инициализации: %v", err)
+		fatal("Произошла ошибка при инициализации", err)
 	}
-	proxyUsecase := service.NewProxyService(historyUC)
+	var socksCredentials *url.Userinfo
+	if cfg.Auth.SOCKSUser != "" {
+		socksCredentials = url.UserPassword(cfg.Auth.SOCKSUser, cfg.Auth.SOCKSPassword)
+	}
+	proxyAuthUC, err := service.NewProxyAuthUsecase(cfg.Auth.ProxyUsersFile, cfg.Auth.ProxyUsers)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	proxyUsecase := service.NewProxyService(historyUC, rewriteUC, interceptUC, scopeUC, passthroughUC, upstreamUC, proxyAuthUC, socksCredentials, timeouts)
 	proxyDelivery := delivery.NewProxy(historyUC, proxyUsecase)
-	err = proxyDelivery.StartProxyServer(wg, *proxyURI)
+	err = proxyDelivery.StartProxyServer(wg, cfg.Listeners.Proxy)
+	if err != nil {
+		fatal("Произошла ошибка при запуске прокси-сервера", err)
+	}
+	var socksDelivery *delivery.Proxy
+	if cfg.Listeners.SOCKS != "" {
+		socksDelivery = delivery.NewSocksProxy(historyUC, proxyUsecase)
+		wg.Add(1)
+		err = socksDelivery.StartProxyServer(wg, cfg.Listeners.SOCKS)
+		if err != nil {
+			fatal("Произошла ошибка при запуске SOCKS-прокси", err)
+		}
+	}
+	var transparentDelivery *delivery.Proxy
+	if cfg.Listeners.Transparent != "" {
+		transparentDelivery = delivery.NewTransparentProxy(historyUC, proxyUsecase)
+		wg.Add(1)
+		err = transparentDelivery.StartProxyServer(wg, cfg.Listeners.Transparent)
+		if err != nil {
+			fatal("Произошла ошибка при запуске прозрачного прокси", err)
+		}
+	}
+	var reverseDelivery *delivery.Proxy
+	if cfg.Listeners.Reverse != "" {
+		reverseUC, err := service.NewReverseUsecase(proxyUsecase, cfg.Reverse.Upstream, cfg.Reverse.Rewrite, timeouts)
+		if err != nil {
+			fatal("Произошла ошибка при инициализации", err)
+		}
+		reverseDelivery = delivery.NewReverseProxy(historyUC, proxyUsecase, reverseUC)
+		wg.Add(1)
+		err = reverseDelivery.StartProxyServer(wg, cfg.Listeners.Reverse)
+		if err != nil {
+			fatal("Произошла ошибка при запуске обратного прокси", err)
+		}
+	}
+	webAuthUC, err := service.NewWebAuthUsecase(cfg.Auth.WebUsersFile, cfg.Auth.WebUsers, cfg.Auth.WebToken)
+	if err != nil {
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	authDelivery, err := delivery.NewAuthDelivery(webAuthUC)
 	if err != nil {
-		log.Fatalf("Произошла ошибка при запуске прокси-сервера: %v", err)
+		fatal("Произошла ошибка при инициализации", err)
+	}
+	liveDelivery := delivery.NewLiveDelivery(liveUC)
+	metricsDelivery := delivery.NewMetricsDelivery()
+	mux := http.NewServeMux()
+	historyDelivery.RegisterRoutes(mux)
+	authDelivery.RegisterRoutes(mux)
+	findingDelivery.RegisterRoutes(mux)
+	ruleDelivery.RegisterRoutes(mux)
+	interceptDelivery.RegisterRoutes(mux)
+	liveDelivery.RegisterRoutes(mux)
+	metricsDelivery.RegisterRoutes(mux)
+	webAddr := cfg.Listeners.Web
+	if cfg.Web.Localhost {
+		// адрес уже проверен при загрузке конфигурации
+		_, port, _ := net.SplitHostPort(webAddr)
+		webAddr = net.JoinHostPort("127.0.0.1", port)
+	}
+	historyServer := historyDelivery.StartHttpServer(wg, authDelivery.Middleware(mux), webAddr)
+	servers := []*http.Server{historyServer}
+	if cfg.Listeners.Metrics != "" {
+		// сборщик метрик не умеет входить в веб-интерфейс, поэтому метрики можно отдать на отдельном адресе
+		metricsMux := http.NewServeMux()
+		metricsDelivery.RegisterRoutes(metricsMux)
+		wg.Add(1)
+		servers = append(servers, historyDelivery.StartHttpServer(wg, metricsMux, cfg.Listeners.Metrics))
 	}
-	historyServer := historyDelivery.StartHttpServer(wg, http.NewServeMux(), *webAddr)
+
+	// по SIGHUP перечитываем конфигурацию и применяем то, что можно изменить без перезапуска
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reloadable := runtimeConfig{
+		level:       logLevel,
+		scope:       scopeUC,
+		rewrite:     rewriteUC,
+		passthrough: passthroughUC,
+		upstream:    upstreamUC,
+		history:     historyUC,
+	}
+	go func(current *config.Config) {
+		for range hup {
+			current = reloadable.reload(loader, current)
+		}
+	}(cfg)
 
 	// ждем сигнала от системы об завершении работы
 	<-sig
-	log.Printf("Получен сигнал завершения работы, выполняем graceful shutdown")
-	// отключаем веб-сервер
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := historyServer.Shutdown(ctx); err != nil {
-			log.Fatalf("Не удалось выполнить graceful shutdown для веб-сервера: %v", err)
-		}
-		log.Printf("Веб-сервер остановлен")
-		cancel()
-		wg.Done()
-	}()
+	slog.Info("Получен сигнал завершения работы, выполняем graceful shutdown")
+	// отключаем веб-серверы. ListenAndServe возвращается сразу, поэтому завершение обработки запросов ждём отдельно
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("Веб-сервер не завершил обработку запросов вовремя", "addr", server.Addr, "error", err)
+				_ = server.Close()
+			}
+			slog.Info("Веб-сервер остановлен", "addr", server.Addr)
+		}(server)
+	}
 	// отключаем прокси
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := proxyDelivery.Shutdown(ctx); err != nil {
-			log.Fatalf("Не удалось выполнить graceful shutdown для прокси-сервера: %v", err)
+	proxies := []*delivery.Proxy{proxyDelivery, socksDelivery, transparentDelivery, reverseDelivery}
+	for _, proxy := range proxies {
+		if proxy == nil {
+			continue
 		}
-		log.Printf("Прокси-сервер остановлен")
-		cancel()
-		wg.Done()
-	}()
+		go func(proxy *delivery.Proxy) {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+			defer cancel()
+			if err := proxy.Shutdown(ctx); err != nil {
+				slog.Warn("Не все соединения завершились вовремя, оставшиеся закрыты принудительно", "error", err)
+			}
+		}(proxy)
+	}
 	wg.Wait()
 }
+
+// fatal записывает в лог ошибку, из-за которой прокси не может работать, и завершает процесс
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// runtimeConfig - части прокси, настройки которых меняются без перезапуска
+type runtimeConfig struct {
+	level       *slog.LevelVar
+	scope       usecase.ScopeUsecase
+	rewrite     usecase.RewriteUsecase
+	passthrough usecase.PassthroughUsecase
+	upstream    usecase.UpstreamUsecase
+	history     usecase.HistoryUsecase
+}
+
+// reload перечитывает конфигурацию и возвращает ту, что теперь действует. Если новая конфигурация некорректна,
+// прокси продолжает работать с текущей. Разделы, которые применяются только при запуске или не применились
+// из-за ошибки, остаются прежними: о них снова сообщится при следующей перезагрузке
+func (r runtimeConfig) reload(loader *config.Loader, current *config.Config) *config.Config {
+	slog.Info("Перезагрузка конфигурации", "file", loader.Filename())
+	next, err := loader.Load()
+	if err != nil {
+		slog.Error("Конфигурация не перезагружена, действуют прежние настройки", "error", err)
+		return current
+	}
+	kept := config.RestartRequired(current, next)
+	for _, section := range kept {
+		slog.Warn("Изменения вступят в силу после перезапуска", "section", section)
+	}
+	applied, failed := r.apply(current, next)
+	for _, f := range failed {
+		slog.Error("Раздел конфигурации не применён, действуют прежние настройки", "section", f.section, "error", f.err)
+		kept = append(kept, f.section)
+	}
+	if len(kept) > 0 {
+		slog.Warn("Конфигурация перезагружена частично", "kept", kept)
+		return applied
+	}
+	slog.Info("Конфигурация перезагружена")
+	return applied
+}
+
+// sectionError - ошибка применения раздела конфигурации
+type sectionError struct {
+	section string
+	err     error
+}
+
+// apply применяет разделы next, которые меняются без перезапуска, и возвращает current с теми из них, что применились,
+// и ошибки разделов, которые остались прежними
+func (r runtimeConfig) apply(current, next *config.Config) (*config.Config, []sectionError) {
+	applied := *current
+	level, _ := logging.ParseLevel(next.Log.Level)
+	r.level.Set(level)
+	applied.Log.Level = next.Log.Level
+	r.passthrough.Configure(next.Passthrough.Hosts, next.Passthrough.After)
+	applied.Passthrough = next.Passthrough
+	metrics.SetHosts(next.Metrics.Hosts)
+	applied.Metrics = next.Metrics
+	failed := make([]sectionError, 0)
+	if err := r.scope.Reload(next.Scope.Entity(), next.Scope.File); err != nil {
+		failed = append(failed, sectionError{"scope", err})
+	} else {
+		applied.Scope = next.Scope
+	}
+	if err := r.rewrite.Reload(next.Rewrite.Entity(), next.Rewrite.RulesFile); err != nil {
+		failed = append(failed, sectionError{"rewrite", err})
+	} else {
+		applied.Rewrite = next.Rewrite
+	}
+	if err := r.upstream.Reload(next.Upstream.Entity()); err != nil {
+		failed = append(failed, sectionError{"upstream", err})
+	} else {
+		applied.Upstream = next.Upstream
+	}
+	if err := r.history.LoadParams(next.Scanner.ParamsFile); err != nil {
+		failed = append(failed, sectionError{"scanner", err})
+	} else {
+		applied.Scanner = next.Scanner
+	}
+	return &applied, failed
+}
@@ -0,0 +1,387 @@
+// Package config собирает настройки прокси из файла YAML, переменных окружения и флагов командной строки.
+// Значение берётся из последнего источника, где оно задано: умолчания, файл, переменные окружения, флаги
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"reflect"
+	"time"
+)
+
+// EnvPrefix - префикс переменных окружения: путь к полю в верхнем регистре с "_" вместо точек,
+// например MITM_PROXY_STORAGE_MONGO_URI для storage.mongo_uri
+const EnvPrefix = "MITM_PROXY_"
+
+type Config struct {
+	Listeners   Listeners   `yaml:"listeners"`
+	Auth        Auth        `yaml:"auth"`
+	Storage     Storage     `yaml:"storage"`
+	CA          CA          `yaml:"ca"`
+	Scope       Scope       `yaml:"scope"`
+	Rewrite     Rewrite     `yaml:"rewrite"`
+	Passthrough Passthrough `yaml:"passthrough"`
+	Upstream    Upstream    `yaml:"upstream"`
+	Reverse     Reverse     `yaml:"reverse"`
+	Scanner     Scanner     `yaml:"scanner"`
+	Intercept   Intercept   `yaml:"intercept"`
+	Timeouts    Timeouts    `yaml:"timeouts"`
+	Web         Web         `yaml:"web"`
+	Log         Log         `yaml:"log"`
+	Metrics     Metrics     `yaml:"metrics"`
+}
+
+// Listeners - адреса слушателей, пустой адрес необязательного слушателя означает, что он не запускается
+type Listeners struct {
+	Proxy       string `yaml:"proxy"`
+	SOCKS       string `yaml:"socks"`
+	Transparent string `yaml:"transparent"`
+	Reverse     string `yaml:"reverse"`
+	Web         string `yaml:"web"`
+	Metrics     string `yaml:"metrics"`
+}
+
+type Auth struct {
+	ProxyUsersFile string   `yaml:"proxy_users_file"`
+	ProxyUsers     []string `yaml:"proxy_users"`
+	SOCKSUser      string   `yaml:"socks_user"`
+	SOCKSPassword  string   `yaml:"socks_password"`
+	WebUsersFile   string   `yaml:"web_users_file"`
+	WebUsers       []string `yaml:"web_users"`
+	WebToken       string   `yaml:"web_token"`
+}
+
+type Storage struct {
+	MongoURI string `yaml:"mongo_uri"`
+	Database string `yaml:"database"`
+}
+
+type CA struct {
+	Key  string `yaml:"key"`
+	Cert string `yaml:"cert"`
+}
+
+// Scope - правила scope. Правила из необязательного JSON-файла File добавляются к заданным здесь
+type Scope struct {
+	Include []ScopeRule `yaml:"include"`
+	Exclude []ScopeRule `yaml:"exclude"`
+	File    string      `yaml:"file"`
+}
+
+type ScopeRule struct {
+	Scheme string `yaml:"scheme"`
+	Host   string `yaml:"host"`
+	Port   string `yaml:"port"`
+	Path   string `yaml:"path"`
+}
+
+// Entity возвращает правила scope в том виде, в котором их принимает usecase
+func (s Scope) Entity() entity.Scope {
+	scope := entity.Scope{
+		Include: make([]entity.ScopeRule, 0, len(s.Include)),
+		Exclude: make([]entity.ScopeRule, 0, len(s.Exclude)),
+	}
+	for _, r := range s.Include {
+		scope.Include = append(scope.Include, r.entity())
+	}
+	for _, r := range s.Exclude {
+		scope.Exclude = append(scope.Exclude, r.entity())
+	}
+	return scope
+}
+
+func (r ScopeRule) entity() entity.ScopeRule {
+	return entity.ScopeRule{Scheme: r.Scheme, Host: r.Host, Port: r.Port, Path: r.Path}
+}
+
+// Rewrite - правила перезаписи. Правила из RulesFile добавляются к заданным здесь, в этот же файл сохраняются
+// правила, изменённые в веб-интерфейсе
+type Rewrite struct {
+	Rules     []RewriteRule `yaml:"rules"`
+	RulesFile string        `yaml:"rules_file"`
+}
+
+type RewriteRule struct {
+	ID        string `yaml:"id"`
+	Name      string `yaml:"name"`
+	Enabled   *bool  `yaml:"enabled"` // по умолчанию правило включено
+	Direction string `yaml:"direction"`
+	Host      string `yaml:"host"`
+	Path      string `yaml:"path"`
+	Method    string `yaml:"method"`
+	Action    string `yaml:"action"`
+	Header    string `yaml:"header"`
+	Pattern   string `yaml:"pattern"`
+	Value     string `yaml:"value"`
+}
+
+// Entity возвращает правила перезаписи в том виде, в котором их принимает usecase
+func (r Rewrite) Entity() []entity.RewriteRule {
+	rules := make([]entity.RewriteRule, 0, len(r.Rules))
+	for _, rule := range r.Rules {
+		rules = append(rules, rule.entity())
+	}
+	return rules
+}
+
+func (r RewriteRule) entity() entity.RewriteRule {
+	return entity.RewriteRule{
+		ID:        r.ID,
+		Name:      r.Name,
+		Enabled:   r.Enabled == nil || *r.Enabled,
+		Direction: entity.RuleDirection(r.Direction),
+		Host:      r.Host,
+		Path:      r.Path,
+		Method:    r.Method,
+		Action:    entity.RuleAction(r.Action),
+		Header:    r.Header,
+		Pattern:   r.Pattern,
+		Value:     r.Value,
+	}
+}
+
+type Passthrough struct {
+	Hosts []string `yaml:"hosts"`
+	// After - число отказов клиента от сертификата до автоматического passthrough, 0 - отключить
+	After int `yaml:"after"`
+}
+
+// Upstream - подключение к серверам. Правила из необязательных JSON-файлов ProxiesFile и ClientCertsFile
+// проверяются после заданных здесь
+type Upstream struct {
+	// Proxy - вышестоящий прокси для хостов, которым не подошло ни одно правило
+	Proxy           string              `yaml:"proxy"`
+	Proxies         []UpstreamProxy     `yaml:"proxies"`
+	ProxiesFile     string              `yaml:"proxies_file"`
+	ClientCerts     []ClientCertificate `yaml:"client_certs"`
+	ClientCertsFile string              `yaml:"client_certs_file"`
+}
+
+type UpstreamProxy struct {
+	Host string `yaml:"host"`
+	URL  string `yaml:"url"`
+}
+
+type ClientCertificate struct {
+	Host       string `yaml:"host"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	PKCS12File string `yaml:"pkcs12_file"`
+	Password   string `yaml:"password"`
+}
+
+// Entity возвращает настройки подключения к серверам в том виде, в котором их принимает usecase
+func (u Upstream) Entity() entity.UpstreamSettings {
+	settings := entity.UpstreamSettings{
+		ClientCerts:     make([]entity.ClientCertificate, 0, len(u.ClientCerts)),
+		ClientCertsFile: u.ClientCertsFile,
+		Proxies:         make([]entity.UpstreamProxy, 0, len(u.Proxies)),
+		ProxiesFile:     u.ProxiesFile,
+		Proxy:           u.Proxy,
+	}
+	for _, c := range u.ClientCerts {
+		settings.ClientCerts = append(settings.ClientCerts, c.entity())
+	}
+	for _, p := range u.Proxies {
+		settings.Proxies = append(settings.Proxies, entity.UpstreamProxy{Host: p.Host, URL: p.URL})
+	}
+	return settings
+}
+
+func (c ClientCertificate) entity() entity.ClientCertificate {
+	return entity.ClientCertificate{
+		Host:       c.Host,
+		CertFile:   c.CertFile,
+		KeyFile:    c.KeyFile,
+		PKCS12File: c.PKCS12File,
+		Password:   c.Password,
+	}
+}
+
+type Reverse struct {
+	Upstream string `yaml:"upstream"`
+	Rewrite  bool   `yaml:"rewrite"`
+}
+
+type Scanner struct {
+	ParamsFile string `yaml:"params_file"`
+}
+
+type Intercept struct {
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type Timeouts struct {
+	Idle           time.Duration `yaml:"idle"`
+	ReadHeader     time.Duration `yaml:"read_header"`
+	Read           time.Duration `yaml:"read"`
+	Write          time.Duration `yaml:"write"`
+	Dial           time.Duration `yaml:"dial"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	Shutdown       time.Duration `yaml:"shutdown"`
+}
+
+// Entity возвращает таймауты обмена в том виде, в котором их принимают usecase
+func (t Timeouts) Entity() entity.Timeouts {
+	return entity.Timeouts{
+		Idle:           t.Idle,
+		ReadHeader:     t.ReadHeader,
+		Read:           t.Read,
+		Write:          t.Write,
+		Dial:           t.Dial,
+		ResponseHeader: t.ResponseHeader,
+	}
+}
+
+type Web struct {
+	// Localhost - принимать подключения к веб-интерфейсу только с localhost
+	Localhost bool   `yaml:"localhost"`
+	Templates string `yaml:"templates"`
+}
+
+type Metrics struct {
+	// Hosts - шаблоны хостов, запросы к которым считаются в метриках по отдельности. Пустой список - хосты из scope
+	Hosts []string `yaml:"hosts"`
+}
+
+type Log struct {
+	Level string `yaml:"level"`
+	JSON  bool   `yaml:"json"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listeners: Listeners{
+			Proxy: ":8000",
+			Web:   ":8080",
+		},
+		Auth: Auth{
+			ProxyUsers: []string{},
+			WebUsers:   []string{},
+		},
+		Storage: Storage{
+			MongoURI: "mongodb://localhost:27017",
+			Database: "proxyDB",
+		},
+		CA: CA{
+			Key:  "ca.key",
+			Cert: "ca.crt",
+		},
+		Scope:       Scope{Include: []ScopeRule{}, Exclude: []ScopeRule{}},
+		Rewrite:     Rewrite{Rules: []RewriteRule{}, RulesFile: "resources/rules.json"},
+		Passthrough: Passthrough{Hosts: []string{}, After: 3},
+		Upstream:    Upstream{Proxies: []UpstreamProxy{}, ClientCerts: []ClientCertificate{}},
+		Scanner:     Scanner{ParamsFile: "resources/params.txt"},
+		Intercept:   Intercept{Timeout: time.Minute},
+		Timeouts: Timeouts{
+			Idle:           2 * time.Minute,
+			ReadHeader:     30 * time.Second,
+			Read:           time.Minute,
+			Write:          time.Minute,
+			Dial:           30 * time.Second,
+			ResponseHeader: 5 * time.Minute,
+			Shutdown:       10 * time.Second,
+		},
+		Web:     Web{Templates: "templates"},
+		Log:     Log{Level: "info"},
+		Metrics: Metrics{Hosts: []string{}},
+	}
+}
+
+// Load собирает конфигурацию: умолчания, затем файл filename (если задан), переменные окружения и overrides -
+// значения по путям вида "storage.mongo_uri". Собранная конфигурация проверяется
+func Load(filename string, overrides map[string]string) (*Config, error) {
+	cfg := Default()
+	if filename != "" {
+		err := readFile(filename, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := applyEnv(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for path, raw := range overrides {
+		value, ok := lookup(cfg, path)
+		if !ok {
+			return nil, fmt.Errorf("неизвестный параметр конфигурации %s", path)
+		}
+		err := setValue(value, raw)
+		if err != nil {
+			return nil, fmt.Errorf("параметр %s: %s", path, err)
+		}
+	}
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), "") {
+		// пустой список в YAML может прийти как null - приводим к одному виду, чтобы сравнивать конфигурации
+		if f.value.Kind() == reflect.Slice && f.value.IsNil() {
+			f.value.Set(reflect.MakeSlice(f.value.Type(), 0, 0))
+		}
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile дополняет cfg значениями из файла. Неизвестные поля считаются ошибкой, чтобы опечатка не оставалась незамеченной
+func readFile(filename string, cfg *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения файла конфигурации: %s", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("ошибка разбора файла конфигурации %s: %s", filename, err)
+	}
+	return nil
+}
+
+// applyEnv применяет переменные окружения с префиксом EnvPrefix
+func applyEnv(cfg *Config) error {
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), "") {
+		name := envName(f.path)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setValue(f.value, raw)
+		if err != nil {
+			return fmt.Errorf("переменная окружения %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// RestartRequired возвращает разделы, которые отличаются в next, но применяются только при запуске
+func RestartRequired(current, next *Config) []string {
+	sections := []struct {
+		name          string
+		current, next any
+	}{
+		{"listeners", current.Listeners, next.Listeners},
+		{"auth", current.Auth, next.Auth},
+		{"storage", current.Storage, next.Storage},
+		{"ca", current.CA, next.CA},
+		{"reverse", current.Reverse, next.Reverse},
+		{"intercept", current.Intercept, next.Intercept},
+		{"timeouts", current.Timeouts, next.Timeouts},
+		{"web", current.Web, next.Web},
+		{"log.json", current.Log.JSON, next.Log.JSON},
+	}
+	changed := make([]string, 0)
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.current, s.next) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
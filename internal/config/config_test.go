@@ -0,0 +1,197 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		// части сообщения об ошибке, пусто - конфигурация корректна
+		want []string
+	}{
+		{
+			name:   "значения по умолчанию",
+			change: func(c *Config) {},
+		},
+		{
+			name: "правила scope, перезаписи и вышестоящие прокси",
+			change: func(c *Config) {
+				c.Scope.Include = []ScopeRule{{Scheme: "https", Host: "*.example.com", Path: "^/api"}}
+				c.Rewrite.Rules = []RewriteRule{{Direction: "request", Action: "remove-header", Header: "Cookie"}}
+				c.Upstream.Proxies = []UpstreamProxy{{Host: "*.onion", URL: "socks5://127.0.0.1:9050"}, {Host: "*.local", URL: "direct"}}
+				c.Upstream.ClientCerts = []ClientCertificate{{Host: "api.example.com", PKCS12File: "client.p12"}}
+			},
+		},
+		{
+			name: "занятый адрес и некорректный таймаут",
+			change: func(c *Config) {
+				c.Listeners.SOCKS = c.Listeners.Proxy
+				c.Timeouts.Idle = -time.Second
+			},
+			want: []string{"listeners.socks: адрес", "timeouts.idle:"},
+		},
+		{
+			name: "некорректное правило scope",
+			change: func(c *Config) {
+				c.Scope.Exclude = []ScopeRule{{Host: "a"}, {Scheme: "ftp"}}
+			},
+			want: []string{"scope.exclude[1]: схема"},
+		},
+		{
+			name: "некорректное правило перезаписи",
+			change: func(c *Config) {
+				c.Rewrite.Rules = []RewriteRule{{Direction: "response", Action: "set-status", Value: "1000"}}
+			},
+			want: []string{"rewrite.rules[0]: некорректный код ответа"},
+		},
+		{
+			name: "вышестоящие прокси",
+			change: func(c *Config) {
+				c.Upstream.Proxy = "ftp://proxy"
+				c.Upstream.Proxies = []UpstreamProxy{{Host: "*"}}
+			},
+			want: []string{"upstream.proxy: некорректный адрес прокси", "upstream.proxies[0].url:"},
+		},
+		{
+			name: "клиентский сертификат без ключа",
+			change: func(c *Config) {
+				c.Upstream.ClientCerts = []ClientCertificate{{Host: "api.example.com", CertFile: "client.crt"}}
+			},
+			want: []string{"upstream.client_certs[0]:"},
+		},
+		{
+			name: "обязательные параметры",
+			change: func(c *Config) {
+				c.Storage.MongoURI = "localhost:27017"
+				c.Web.Templates = ""
+			},
+			want: []string{"storage.mongo_uri:", "web.templates:"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Web.Templates = t.TempDir()
+			tt.change(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("неожиданная ошибка: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("ожидалась ошибка")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("в ошибке %q нет %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		// содержимое файла конфигурации, пусто - без файла
+		file string
+		env  map[string]string
+		// проверяет загруженную конфигурацию
+		check   func(t *testing.T, c *Config)
+		wantErr string
+	}{
+		{
+			name: "строка и список строк",
+			env: map[string]string{
+				"MITM_PROXY_STORAGE_DATABASE": "test",
+				"MITM_PROXY_METRICS_HOSTS":    "a.example.com, *.example.org",
+			},
+			check: func(t *testing.T, c *Config) {
+				if c.Storage.Database != "test" {
+					t.Errorf("storage.database = %q", c.Storage.Database)
+				}
+				if !reflect.DeepEqual(c.Metrics.Hosts, []string{"a.example.com", "*.example.org"}) {
+					t.Errorf("metrics.hosts = %q", c.Metrics.Hosts)
+				}
+			},
+		},
+		{
+			name: "список правил в JSON",
+			env:  map[string]string{"MITM_PROXY_SCOPE_INCLUDE": `[{"scheme": "https", "host": "*.example.com"}]`},
+			check: func(t *testing.T, c *Config) {
+				want := []ScopeRule{{Scheme: "https", Host: "*.example.com"}}
+				if !reflect.DeepEqual(c.Scope.Include, want) {
+					t.Errorf("scope.include = %+v", c.Scope.Include)
+				}
+			},
+		},
+		{
+			name: "переменная окружения важнее файла",
+			file: "upstream:\n  proxies:\n    - {host: \"*\", url: direct}\n",
+			env:  map[string]string{"MITM_PROXY_UPSTREAM_PROXIES": `[{host: "*.onion", url: "socks5://127.0.0.1:9050"}]`},
+			check: func(t *testing.T, c *Config) {
+				want := []UpstreamProxy{{Host: "*.onion", URL: "socks5://127.0.0.1:9050"}}
+				if !reflect.DeepEqual(c.Upstream.Proxies, want) {
+					t.Errorf("upstream.proxies = %+v", c.Upstream.Proxies)
+				}
+			},
+		},
+		{
+			name: "правило перезаписи из файла включено по умолчанию",
+			file: "rewrite:\n  rules:\n    - {direction: request, action: remove-header, header: Cookie}\n",
+			check: func(t *testing.T, c *Config) {
+				rules := c.Rewrite.Entity()
+				if len(rules) != 1 || !rules[0].Enabled {
+					t.Errorf("правила перезаписи: %+v", rules)
+				}
+			},
+		},
+		{
+			name:    "неизвестное поле правила",
+			env:     map[string]string{"MITM_PROXY_SCOPE_EXCLUDE": `[{"hostname": "example.com"}]`},
+			wantErr: "MITM_PROXY_SCOPE_EXCLUDE",
+		},
+		{
+			name:    "некорректное правило проверяется после переопределения",
+			env:     map[string]string{"MITM_PROXY_UPSTREAM_CLIENT_CERTS": `[{"host": "a", "cert_file": "a.crt"}]`},
+			wantErr: "upstream.client_certs[0]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			filename := ""
+			if tt.file != "" {
+				filename = filepath.Join(t.TempDir(), "config.yaml")
+				err := os.WriteFile(filename, []byte(tt.file), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := Load(filename, map[string]string{"web.templates": t.TempDir()})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ошибка %v, ожидалась ошибка с %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
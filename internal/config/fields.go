@@ -0,0 +1,122 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field - параметр конфигурации с путём из имён YAML через точку, например "timeouts.idle"
+type field struct {
+	path  string
+	value reflect.Value
+}
+
+// fields перечисляет параметры структуры v, вложенные разделы обходятся рекурсивно
+func fields(v reflect.Value, prefix string) []field {
+	result := make([]field, 0)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("yaml")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct {
+			result = append(result, fields(value, name)...)
+			continue
+		}
+		result = append(result, field{path: name, value: value})
+	}
+	return result
+}
+
+// lookup находит параметр по пути
+func lookup(cfg *Config, path string) (reflect.Value, bool) {
+	for _, f := range fields(reflect.ValueOf(cfg).Elem(), "") {
+		if f.path == path {
+			return f.value, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// setValue разбирает строковое значение из переменной окружения или флага. Списки строк задаются через запятую
+func setValue(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("некорректная длительность %q, ожидается значение вида 30s или 2m", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("некорректное логическое значение %q, ожидается true или false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("некорректное число %q", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.ValueOf(splitList(raw)))
+			return nil
+		}
+		// списки правил задаются так же, как в файле: в YAML или JSON, например [{"host": "*.example.com"}]
+		list := reflect.New(v.Type())
+		decoder := yaml.NewDecoder(strings.NewReader(raw))
+		decoder.KnownFields(true)
+		err := decoder.Decode(list.Interface())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("некорректный список %q: %s", raw, err)
+		}
+		if list.Elem().IsNil() {
+			list.Elem().Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+		v.Set(list.Elem())
+	default:
+		return fmt.Errorf("неподдерживаемый тип параметра %s", v.Type())
+	}
+	return nil
+}
+
+// formatValue записывает значение параметра в том же виде, в котором его принимает setValue
+func formatValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// splitList разбирает список через запятую
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/logging"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate проверяет конфигурацию и сообщает обо всех ошибках сразу, с путём к каждому параметру
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.required("listeners.proxy", c.Listeners.Proxy)
+	v.required("listeners.web", c.Listeners.Web)
+	listeners := []struct {
+		path string
+		addr string
+	}{
+		{"listeners.proxy", c.Listeners.Proxy},
+		{"listeners.socks", c.Listeners.SOCKS},
+		{"listeners.transparent", c.Listeners.Transparent},
+		{"listeners.reverse", c.Listeners.Reverse},
+		{"listeners.web", c.Listeners.Web},
+		{"listeners.metrics", c.Listeners.Metrics},
+	}
+	used := make(map[string]string)
+	for _, l := range listeners {
+		if l.addr == "" {
+			continue
+		}
+		v.addr(l.path, l.addr)
+		if other, ok := used[l.addr]; ok {
+			v.add(l.path, "адрес %q уже занят параметром %s", l.addr, other)
+		}
+		used[l.addr] = l.path
+	}
+
+	v.users("auth.proxy_users", c.Auth.ProxyUsers)
+	v.users("auth.web_users", c.Auth.WebUsers)
+	if c.Auth.SOCKSPassword != "" && c.Auth.SOCKSUser == "" {
+		v.add("auth.socks_password", "пароль задан без auth.socks_user")
+	}
+
+	if v.required("storage.mongo_uri", c.Storage.MongoURI) &&
+		!strings.HasPrefix(c.Storage.MongoURI, "mongodb://") && !strings.HasPrefix(c.Storage.MongoURI, "mongodb+srv://") {
+		v.add("storage.mongo_uri", "адрес должен начинаться с mongodb:// или mongodb+srv://")
+	}
+	v.required("storage.database", c.Storage.Database)
+	v.required("ca.key", c.CA.Key)
+	v.required("ca.cert", c.CA.Cert)
+	v.required("scanner.params_file", c.Scanner.ParamsFile)
+	for i, rule := range c.Scope.Include {
+		v.check(fmt.Sprintf("scope.include[%d]", i), rule.entity().Validate())
+	}
+	for i, rule := range c.Scope.Exclude {
+		v.check(fmt.Sprintf("scope.exclude[%d]", i), rule.entity().Validate())
+	}
+	for i, rule := range c.Rewrite.Rules {
+		v.check(fmt.Sprintf("rewrite.rules[%d]", i), rule.entity().Validate())
+	}
+
+	if c.Passthrough.After < 0 {
+		v.add("passthrough.after", "число отказов не может быть отрицательным")
+	}
+	if c.Upstream.Proxy != "" {
+		v.upstreamProxy("upstream.proxy", c.Upstream.Proxy)
+	}
+	for i, proxy := range c.Upstream.Proxies {
+		path := fmt.Sprintf("upstream.proxies[%d].url", i)
+		if v.required(path, proxy.URL) {
+			v.upstreamProxy(path, proxy.URL)
+		}
+	}
+	for i, cert := range c.Upstream.ClientCerts {
+		v.check(fmt.Sprintf("upstream.client_certs[%d]", i), cert.entity().Validate())
+	}
+	if c.Listeners.Reverse != "" && v.required("reverse.upstream", c.Reverse.Upstream) {
+		v.url("reverse.upstream", c.Reverse.Upstream, "http", "https")
+	}
+
+	if c.Intercept.Timeout <= 0 {
+		v.add("intercept.timeout", "время ожидания должно быть больше нуля")
+	}
+	timeouts := []struct {
+		path  string
+		value time.Duration
+	}{
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"timeouts.read_header", c.Timeouts.ReadHeader},
+		{"timeouts.read", c.Timeouts.Read},
+		{"timeouts.write", c.Timeouts.Write},
+		{"timeouts.dial", c.Timeouts.Dial},
+		{"timeouts.response_header", c.Timeouts.ResponseHeader},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			v.add(t.path, "таймаут не может быть отрицательным")
+		}
+	}
+
+	if v.required("web.templates", c.Web.Templates) {
+		info, err := os.Stat(c.Web.Templates)
+		if err != nil {
+			v.add("web.templates", "каталог с шаблонами недоступен: %s", err)
+		} else if !info.IsDir() {
+			v.add("web.templates", "%s не является каталогом", c.Web.Templates)
+		}
+	}
+	_, err := logging.ParseLevel(c.Log.Level)
+	if err != nil {
+		v.add("log.level", "%s", err)
+	}
+
+	if len(v.problems) > 0 {
+		// одной строкой, чтобы сообщение целиком читалось и в текстовом, и в JSON-логе
+		return fmt.Errorf("некорректная конфигурация: %s", strings.Join(v.problems, "; "))
+	}
+	return nil
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// check сообщает об ошибке проверки err, если она есть
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.add(path, "%s", err)
+	}
+}
+
+func (v *validator) upstreamProxy(path, raw string) {
+	_, err := entity.ParseUpstreamProxy(raw)
+	if err != nil {
+		v.add(path, "некорректный адрес прокси %q: %s", raw, err)
+	}
+}
+
+// required сообщает об ошибке, если значение пустое, и возвращает, задано ли оно
+func (v *validator) required(path, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(path, "значение не задано")
+		return false
+	}
+	return true
+}
+
+func (v *validator) addr(path, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add(path, "некорректный адрес %q, ожидается host:port или :port", addr)
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		v.add(path, "некорректный порт %q", port)
+	}
+}
+
+func (v *validator) url(path, raw string, schemes ...string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.add(path, "некорректный адрес %q: %s", raw, err)
+		return
+	}
+	if u.Host == "" {
+		v.add(path, "в адресе %q не указан хост", raw)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return
+		}
+	}
+	v.add(path, "схема %q не поддерживается, допустимы: %s", u.Scheme, strings.Join(schemes, ", "))
+}
+
+func (v *validator) users(path string, users []string) {
+	for _, user := range users {
+		name, _, ok := strings.Cut(user, ":")
+		if !ok || name == "" {
+			v.add(path, "пользователь должен быть задан в виде user:password")
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package delivery
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sessionCookie = "session"
+	csrfField     = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+type Auth struct {
+	webAuthUsecase usecase.WebAuthUsecase
+	templates      map[string]*template.Template
+}
+
+func NewAuthDelivery(webAuthUC usecase.WebAuthUsecase) (*Auth, error) {
+	d := Auth{
+		webAuthUsecase: webAuthUC,
+	}
+
+	d.templates = make(map[string]*template.Template)
+	tmpl, err := parseTemplate("login.html")
+	if err != nil {
+		return nil, err
+	}
+	d.templates["login"] = tmpl
+
+	return &d, nil
+}
+
+func (a *Auth) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/login", a.Login)
+	mux.HandleFunc("/logout", a.Logout)
+}
+
+type sessionKey struct{}
+
+// Middleware пускает к веб-интерфейсу только пользователей с сессией и проверяет CSRF-токен у изменяющих запросов.
+// Страница входа и тестовый endpoint "/", к которому обращается param miner, доступны без сессии
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" || r.URL.Path == "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, ok := a.session(r)
+		if !ok && !a.webAuthUsecase.Enabled() {
+			if !pageLoad(r) {
+				// без аутентификации сессия нужна только для CSRF-токена, а его выдаёт страница. Запросы без
+				// cookie (curl, сборщики метрик) не получают сессию, иначе каждый из них оставлял бы новую
+				if !safeMethod(r.Method) {
+					http.Error(w, "Некорректный CSRF-токен", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			var err error
+			session, err = a.webAuthUsecase.AnonymousSession()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+				return
+			}
+			setSessionCookie(w, session)
+			ok = true
+		}
+		if !ok {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "Требуется вход в веб-интерфейс", http.StatusUnauthorized)
+			return
+		}
+
+		if !safeMethod(r.Method) && !validCSRF(r, session) {
+			http.Error(w, "Некорректный CSRF-токен", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, session)))
+	})
+}
+
+func (a *Auth) session(r *http.Request) (*entity.Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	return a.webAuthUsecase.Session(cookie.Value)
+}
+
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		// переадресуем только внутри веб-интерфейса
+		next = "/requests"
+	}
+	if !a.webAuthUsecase.Enabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Next  string
+		Error string
+	}{Next: next}
+	if r.Method == http.MethodPost {
+		var session *entity.Session
+		var err error
+		if token := r.FormValue("token"); token != "" {
+			session, err = a.webAuthUsecase.LoginToken(token)
+		} else {
+			session, err = a.webAuthUsecase.Login(r.FormValue("username"), r.FormValue("password"))
+		}
+		if err == nil {
+			setSessionCookie(w, session)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		if !errors.Is(err, usecase.ErrInvalidCredentials) {
+			http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+			return
+		}
+		data.Error = "Неверный логин, пароль или токен"
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	err := render(w, r, a.templates["login"], data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+	if session, ok := r.Context().Value(sessionKey{}).(*entity.Session); ok {
+		a.webAuthUsecase.Logout(session.ID)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func setSessionCookie(w http.ResponseWriter, session *entity.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		// страницы, открытые через прокси, не должны отправлять запросы к веб-интерфейсу от имени пользователя
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// pageLoad проверяет, что браузер открывает HTML-страницу: в ней формы и скрипты получают CSRF-токен сессии
+func pageLoad(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func validCSRF(r *http.Request, session *entity.Session) bool {
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfField)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+// templatesDir - каталог с шаблонами веб-интерфейса
+var templatesDir = "templates"
+
+// SetTemplatesDir задаёт каталог с шаблонами веб-интерфейса. Шаблоны читаются при создании delivery, поэтому
+// каталог нужно задать до этого
+func SetTemplatesDir(dir string) {
+	templatesDir = dir
+}
+
+func templatePath(name string) string {
+	return filepath.Join(templatesDir, name)
+}
+
+// parseTemplate разбирает шаблон с функциями csrfField, csrfToken и sessionUser. Настоящие значения подставляются в render
+func parseTemplate(name string) (*template.Template, error) {
+	return template.New(name).Funcs(sessionFuncs(&entity.Session{})).ParseFiles(templatePath(name))
+}
+
+// render выполняет копию шаблона со значениями из сессии текущего запроса
+func render(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data any) error {
+	session, ok := r.Context().Value(sessionKey{}).(*entity.Session)
+	if !ok {
+		session = &entity.Session{}
+	}
+	t, err := tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	return t.Funcs(sessionFuncs(session)).Execute(w, data)
+}
+
+func sessionFuncs(session *entity.Session) template.FuncMap {
+	return template.FuncMap{
+		"sessionUser": func() string {
+			return session.User
+		},
+		"csrfToken": func() string {
+			return session.CSRFToken
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfField, template.HTMLEscapeString(session.CSRFToken)))
+		},
+	}
+}
@@ -0,0 +1,104 @@
+package delivery
+
+import (
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type Finding struct {
+	findingUsecase usecase.FindingUsecase
+	templates      map[string]*template.Template
+}
+
+func NewFindingDelivery(findingUC usecase.FindingUsecase) (*Finding, error) {
+	d := Finding{
+		findingUsecase: findingUC,
+	}
+
+	d.templates = make(map[string]*template.Template)
+	tmpl, err := parseTemplate("findings.html")
+	if err != nil {
+		return nil, err
+	}
+	d.templates["findings"] = tmpl
+
+	return &d, nil
+}
+
+func (f *Finding) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/findings", f.Dashboard)
+	mux.HandleFunc("/findings/status/", f.SetStatus)
+	mux.HandleFunc("/findings/export", f.Export)
+}
+
+func (f *Finding) Dashboard(w http.ResponseWriter, r *http.Request) {
+	groups, err := f.findingUsecase.FindingDashboard()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Groups   []entity.HostFindings
+		Statuses []entity.FindingStatus
+	}{
+		Groups:   groups,
+		Statuses: []entity.FindingStatus{entity.FindingStatusOpen, entity.FindingStatusFalsePositive, entity.FindingStatusFixed},
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = render(w, r, f.templates["findings"], data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (f *Finding) SetStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/findings/status/")
+	_, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Невалидный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	err = f.findingUsecase.SetFindingStatus(id, entity.FindingStatus(r.FormValue("status")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось изменить статус: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/findings", http.StatusSeeOther)
+}
+
+func (f *Finding) Export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	report, contentType, err := f.findingUsecase.ExportFindings(format)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось сформировать отчёт: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	extension := "json"
+	if strings.HasPrefix(contentType, "text/markdown") {
+		extension = "md"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"findings.%s\"", extension))
+	_, err = w.Write(report)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+	}
+}
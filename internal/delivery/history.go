@@ -1,66 +1,84 @@
 package delivery
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/blackHATred/mitm_proxy/internal/entity"
 	"github.com/blackHATred/mitm_proxy/internal/usecase"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
 
 type History struct {
 	historyUsecase usecase.HistoryUsecase
+	scannerUsecase usecase.ScannerUsecase
+	scopeUsecase   usecase.ScopeUsecase
 	templates      map[string]*template.Template
 }
 
-func NewHistoryDelivery(historyUC usecase.HistoryUsecase) (*History, error) {
+func NewHistoryDelivery(historyUC usecase.HistoryUsecase, scannerUC usecase.ScannerUsecase, scopeUC usecase.ScopeUsecase) (*History, error) {
 	d := History{
 		historyUsecase: historyUC,
+		scannerUsecase: scannerUC,
+		scopeUsecase:   scopeUC,
 	}
 
 	d.templates = make(map[string]*template.Template)
-	tmpl, err := template.ParseFiles("templates/requests.html")
+	tmpl, err := parseTemplate("requests.html")
 	if err != nil {
 		return nil, err
 	}
 	d.templates["requests"] = tmpl
-	tmpl, err = template.ParseFiles("templates/request_details.html")
+	tmpl, err = parseTemplate("request_details.html")
 	if err != nil {
 		return nil, err
 	}
 	d.templates["request_details"] = tmpl
-	tmpl, err = template.ParseFiles("templates/scanned_params.html")
+	tmpl, err = template.ParseFiles(templatePath("scanned_params.html"))
 	if err != nil {
 		return nil, err
 	}
 	d.templates["scanned_params"] = tmpl
+	tmpl, err = template.ParseFiles(templatePath("active_scan.html"))
+	if err != nil {
+		return nil, err
+	}
+	d.templates["active_scan"] = tmpl
 
 	return &d, nil
 }
 
-func (h *History) StartHttpServer(wg *sync.WaitGroup, mux *http.ServeMux, addr string) *http.Server {
-	srv := &http.Server{Addr: addr}
+func (h *History) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/requests", h.RequestsList)
 	mux.HandleFunc("/requests/", h.RequestDetails)
+	mux.HandleFunc("/exchange/", h.Exchange)
+	mux.HandleFunc("/stream/", h.StreamEvents)
 	mux.HandleFunc("/repeat/", h.RequestRepeat)
 	mux.HandleFunc("/scan/", h.Scan)
+	mux.HandleFunc("/active-scan/", h.ActiveScan)
 	mux.HandleFunc("/", h.Example)
-	srv.Handler = mux
+}
+
+func (h *History) StartHttpServer(wg *sync.WaitGroup, handler http.Handler, addr string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler}
 
 	go func() {
 		defer wg.Done()
 
 		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("ListenAndServe(): %v", err)
+			slog.Error("Ошибка работы web-интерфейса", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	log.Printf("HTTP-сервер запущен на %s", addr)
+	slog.Info("Web-интерфейс запущен", "addr", addr)
 	return srv
 }
 
@@ -72,7 +90,7 @@ func (h *History) RequestsList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	err = h.templates["requests"].Execute(w, list)
+	err = render(w, r, h.templates["requests"], list)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
 	}
@@ -91,22 +109,76 @@ func (h *History) RequestDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	findings, err := h.scannerUsecase.HistoryFindings(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+		return
+	}
+
 	data := struct {
 		entity.HistoryObject
-		ID string
+		ID       string
+		Findings []entity.Finding
 	}{
 		HistoryObject: *details,
 		ID:            id,
+		Findings:      findings,
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	err = h.templates["request_details"].Execute(w, data)
+	err = render(w, r, h.templates["request_details"], data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// Exchange перенаправляет на запрос из истории по идентификатору обмена из лога
+func (h *History) Exchange(w http.ResponseWriter, r *http.Request) {
+	exchangeID := strings.TrimPrefix(r.URL.Path, "/exchange/")
+	id, err := h.historyUsecase.FindByExchangeID(exchangeID)
+	if errors.Is(err, usecase.ErrExchangeNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/requests/%s", id), http.StatusSeeOther)
+}
+
+// StreamEvents отдаёт в JSON состояние потокового ответа и его события, начиная с номера from
+func (h *History) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/stream/")
+	_, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Невалидный формат ID", http.StatusBadRequest)
+		return
+	}
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		from = 0
+	}
+
+	stream, err := h.historyUsecase.StreamEvents(id, from)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(stream)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
 	}
 }
 
 func (h *History) RequestRepeat(w http.ResponseWriter, r *http.Request) {
+	// инструменты отправляют запросы от имени пользователя, поэтому запускаются только POST-запросом с CSRF-токеном
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
 	id := strings.TrimPrefix(r.URL.Path, "/repeat/")
 	_, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -114,10 +186,10 @@ func (h *History) RequestRepeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Повторяем запрос
-	newID, err := h.historyUsecase.RequestRepeat(id)
+	// Повторяем запрос, при raw - байт в байт
+	newID, err := h.historyUsecase.RequestRepeat(id, r.FormValue("raw") != "")
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+		toolError(w, err)
 		return
 	}
 
@@ -125,12 +197,20 @@ func (h *History) RequestRepeat(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *History) Scan(w http.ResponseWriter, r *http.Request) {
+	// инструменты отправляют запросы от имени пользователя, поэтому запускаются только POST-запросом с CSRF-токеном
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
 	id := strings.TrimPrefix(r.URL.Path, "/scan/")
 	_, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		http.Error(w, "Невалидный формат ID", http.StatusBadRequest)
 		return
 	}
+	if !h.checkScope(w, id) {
+		return
+	}
 
 	// включаем режим chunked передачи данных
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -150,7 +230,7 @@ func (h *History) Scan(w http.ResponseWriter, r *http.Request) {
 
 	searchedParams, err := h.historyUsecase.RequestScan(id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+		toolError(w, err)
 		return
 	}
 
@@ -167,6 +247,83 @@ func (h *History) Scan(w http.ResponseWriter, r *http.Request) {
 	flusher.Flush()
 }
 
+func (h *History) ActiveScan(w http.ResponseWriter, r *http.Request) {
+	// инструменты отправляют запросы от имени пользователя, поэтому запускаются только POST-запросом с CSRF-токеном
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/active-scan/")
+	_, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		http.Error(w, "Невалидный формат ID", http.StatusBadRequest)
+		return
+	}
+	if !h.checkScope(w, id) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Chunked Transfer Encoding не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write([]byte("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n    <meta charset=\"UTF-8\">\n    <title>Active Scan</title>\n    <link href=\"https://cdn.jsdelivr.net/npm/bootstrap@5.3.3/dist/css/bootstrap.min.css\" rel=\"stylesheet\" integrity=\"sha384-QWTKZyjpPEjISv5WaRU9OFeRpok6YctnYmDr5pNlyT2bRjXh0JMhjY6hW+ALEwIH\" crossorigin=\"anonymous\">\n</head>\n<body>\n<h1>Активное сканирование...</h1>\n<h3>Не закрывайте и не перезагружайте страницу, пока не увидите надпись \"Сканирование завершено\". </h3>\n<h3>Каждый параметр проверяется на XSS, SQL-инъекции, обход каталога, открытое перенаправление, SSRF и внедрение команд.</h3>"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+		return
+	}
+	flusher.Flush()
+
+	findings, err := h.scannerUsecase.ActiveScan(id)
+	if err != nil {
+		toolError(w, err)
+		return
+	}
+
+	err = h.templates["active_scan"].Execute(w, findings)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+
+	_, err = w.Write([]byte("<h1>Сканирование завершено</h1>\n</body>\n</html>"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+		return
+	}
+	flusher.Flush()
+}
+
+// toolError отдаёт ошибку инструмента: цель вне scope - это отказ, а не внутренняя ошибка сервера
+// checkScope проверяет scope до начала потоковой страницы сканирования: после отправки заголовков
+// статус ответа уже не поменять, и запрос вне scope получил бы 200 с ошибкой в теле
+func (h *History) checkScope(w http.ResponseWriter, id string) bool {
+	obj, err := h.historyUsecase.RequestDetails(id)
+	if err == nil {
+		err = h.scopeUsecase.CheckURL(obj.Request.URL)
+	}
+	if err != nil {
+		toolError(w, err)
+		return false
+	}
+	return true
+}
+
+func toolError(w http.ResponseWriter, err error) {
+	if errors.Is(err, usecase.ErrOutOfScope) {
+		http.Error(w, fmt.Sprintf("Запрос отклонён: %v", err), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, usecase.ErrNoRawRequest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %v", err), http.StatusInternalServerError)
+}
+
 func (h *History) Example(w http.ResponseWriter, r *http.Request) {
 	// если в запросе есть параметр "url", то возвращаем его в теле ответа, иначе возвращаем "Hello, World!"
 	url := r.URL.Query().Get("url")
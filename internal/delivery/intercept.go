@@ -0,0 +1,95 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type Intercept struct {
+	interceptUsecase usecase.InterceptUsecase
+	templates        map[string]*template.Template
+}
+
+func NewInterceptDelivery(interceptUC usecase.InterceptUsecase) (*Intercept, error) {
+	d := Intercept{
+		interceptUsecase: interceptUC,
+	}
+
+	d.templates = make(map[string]*template.Template)
+	tmpl, err := parseTemplate("intercept.html")
+	if err != nil {
+		return nil, err
+	}
+	d.templates["intercept"] = tmpl
+
+	return &d, nil
+}
+
+func (i *Intercept) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/intercept", i.Page)
+	mux.HandleFunc("/intercept/pending", i.Pending)
+	mux.HandleFunc("/intercept/filter", i.SetFilter)
+	mux.HandleFunc("/intercept/resolve/", i.Resolve)
+}
+
+func (i *Intercept) Page(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := render(w, r, i.templates["intercept"], i.interceptUsecase.Filter())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (i *Intercept) Pending(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(i.interceptUsecase.Pending())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (i *Intercept) SetFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := entity.InterceptFilter{
+		Enabled:   r.FormValue("enabled") != "",
+		Responses: r.FormValue("responses") != "",
+		Host:      strings.TrimSpace(r.FormValue("host")),
+		Path:      r.FormValue("path"),
+		Method:    strings.ToUpper(strings.TrimSpace(r.FormValue("method"))),
+	}
+	err := i.interceptUsecase.SetFilter(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось изменить фильтр: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/intercept", http.StatusSeeOther)
+}
+
+func (i *Intercept) Resolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decision := entity.InterceptDecision{
+		Action: entity.InterceptAction(r.FormValue("action")),
+		Raw:    r.FormValue("raw"),
+	}
+	err := i.interceptUsecase.Resolve(strings.TrimPrefix(r.URL.Path, "/intercept/resolve/"), decision)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось обработать сообщение: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
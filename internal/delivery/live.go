@@ -0,0 +1,98 @@
+package delivery
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// liveWriteTimeout ограничивает отправку одного сообщения клиенту живой ленты
+	liveWriteTimeout = 10 * time.Second
+	// livePingPeriod - период ping-сообщений, по которым обнаруживаются оборванные соединения
+	livePingPeriod = 30 * time.Second
+)
+
+type Live struct {
+	liveUsecase usecase.LiveUsecase
+	// по умолчанию Upgrader принимает подключения только со страниц того же хоста,
+	// поэтому чужой сайт не сможет читать ленту от имени пользователя с открытой сессией
+	upgrader websocket.Upgrader
+}
+
+func NewLiveDelivery(liveUC usecase.LiveUsecase) *Live {
+	return &Live{liveUsecase: liveUC}
+}
+
+func (l *Live) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/live", l.Feed)
+}
+
+// Feed отправляет по WebSocket события о новых обменах и ходе сканирования. Начальный фильтр задаётся
+// параметрами запроса, новый клиент может прислать в любой момент сообщением в формате JSON
+func (l *Live) Feed(w http.ResponseWriter, r *http.Request) {
+	conn, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade сам отвечает клиенту ошибкой
+		slog.Warn("Ошибка подключения к живой ленте", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	filters := make(chan entity.LiveFilter)
+	go func() {
+		defer close(filters)
+		for {
+			var filter entity.LiveFilter
+			if err := conn.ReadJSON(&filter); err != nil {
+				// клиент закрыл соединение или прислал не фильтр
+				return
+			}
+			select {
+			case filters <- filter:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	events, unsubscribe := l.liveUsecase.Subscribe(liveFilter(r.URL.Query()))
+	defer func() { unsubscribe() }()
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case event := <-events:
+			_ = conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case filter, ok := <-filters:
+			if !ok {
+				return
+			}
+			unsubscribe()
+			events, unsubscribe = l.liveUsecase.Subscribe(filter)
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func liveFilter(query url.Values) entity.LiveFilter {
+	return entity.LiveFilter{
+		URL:        query.Get("url"),
+		Method:     query.Get("method"),
+		Status:     query.Get("status"),
+		User:       query.Get("user"),
+		ErrorsOnly: query.Get("errors_only") != "",
+	}
+}
@@ -0,0 +1,19 @@
+package delivery
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
+	"net/http"
+)
+
+// Metrics отдаёт метрики прокси в текстовом формате Prometheus
+type Metrics struct {
+	handler http.Handler
+}
+
+func NewMetricsDelivery() *Metrics {
+	return &Metrics{handler: metrics.Handler()}
+}
+
+func (m *Metrics) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/metrics", m.handler)
+}
@@ -3,10 +3,15 @@ package delivery
 import (
 	"context"
 	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/logging"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
 	"github.com/blackHATred/mitm_proxy/internal/usecase"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Proxy struct {
@@ -16,6 +21,15 @@ type Proxy struct {
 	cancel         context.CancelFunc
 	historyUsecase usecase.HistoryUsecase
 	proxyUsecase   usecase.ProxyUsecase
+	// handler обрабатывает принятое соединение в зависимости от протокола слушателя
+	handler func(conn net.Conn) error
+	name    string
+	// label отличает слушатель в метриках
+	label string
+	// открытые соединения клиентов, которые закрываются принудительно, если не успели завершиться при остановке
+	mu       sync.Mutex
+	conns    map[*trackedConn]struct{}
+	draining bool
 }
 
 func NewProxy(h usecase.HistoryUsecase, p usecase.ProxyUsecase) *Proxy {
@@ -23,7 +37,38 @@ func NewProxy(h usecase.HistoryUsecase, p usecase.ProxyUsecase) *Proxy {
 	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
 	proxy.historyUsecase = h
 	proxy.wg = sync.WaitGroup{}
+	proxy.conns = make(map[*trackedConn]struct{})
 	proxy.proxyUsecase = p
+	proxy.handler = p.HandleConn
+	proxy.name = "Прокси-сервер"
+	proxy.label = "http"
+	return proxy
+}
+
+// NewSocksProxy создаёт слушатель, принимающий клиентов по протоколу SOCKS5
+func NewSocksProxy(h usecase.HistoryUsecase, p usecase.ProxyUsecase) *Proxy {
+	proxy := NewProxy(h, p)
+	proxy.handler = p.HandleSocksConn
+	proxy.name = "SOCKS-прокси"
+	proxy.label = "socks"
+	return proxy
+}
+
+// NewTransparentProxy создаёт слушатель для трафика, перенаправленного на прокси правилами iptables
+func NewTransparentProxy(h usecase.HistoryUsecase, p usecase.ProxyUsecase) *Proxy {
+	proxy := NewProxy(h, p)
+	proxy.handler = p.HandleTransparentConn
+	proxy.name = "Прозрачный прокси"
+	proxy.label = "transparent"
+	return proxy
+}
+
+// NewReverseProxy создаёт слушатель обратного прокси перед заранее заданным сервером
+func NewReverseProxy(h usecase.HistoryUsecase, p usecase.ProxyUsecase, r usecase.ReverseUsecase) *Proxy {
+	proxy := NewProxy(h, p)
+	proxy.handler = r.HandleConn
+	proxy.name = "Обратный прокси"
+	proxy.label = "reverse"
 	return proxy
 }
 
@@ -42,11 +87,12 @@ func (p *Proxy) StartProxyServer(wg *sync.WaitGroup, addr string) error {
 		defer wg.Done()
 
 		if err := p.ListenAndServe(); !errors.Is(err, net.ErrClosed) {
-			log.Fatalf("ListenAndServe(): %v", err)
+			slog.Error("Ошибка работы слушателя", "listener", p.name, "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	log.Printf("Прокси-сервер запущен на %s", addr)
+	slog.Info("Слушатель запущен", "listener", p.name, "addr", addr)
 	return nil
 }
 
@@ -57,29 +103,57 @@ Listen:
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				// Прокси был завершен, выходим
-				log.Printf("Прокси-сервер завершен\n")
+				slog.Info("Слушатель больше не принимает соединения", "listener", p.name)
 				break Listen
 			}
-			log.Printf("Ошибка приёма входящего соединения: %v\n", err)
+			slog.Warn("Ошибка приёма входящего соединения", "listener", p.name, "error", err)
+			continue
+		}
+		tracked, ok := p.track(conn)
+		if !ok {
+			// остановка уже началась
+			conn.Close()
 			continue
 		}
 		p.wg.Add(1)
 		go func() {
-			err := p.proxyUsecase.HandleConn(conn)
+			defer p.wg.Done()
+			defer p.untrack(tracked)
+			metrics.Connections.WithLabelValues(p.label).Inc()
+			metrics.ActiveConnections.WithLabelValues(p.label).Inc()
+			defer metrics.ActiveConnections.WithLabelValues(p.label).Dec()
+			slog.DebugContext(tracked.ctx, "Новое соединение", "listener", p.name, "client", conn.RemoteAddr().String())
+			err := p.handler(tracked)
 			if err != nil {
-				log.Printf("Произошла ошибка: %v\n", err)
+				slog.WarnContext(tracked.ctx, "Ошибка обработки соединения", "listener", p.name, "error", err)
 			}
-			p.wg.Done()
 		}()
 	}
 	// ждем, пока не обработаем все соединения
 	p.wg.Wait()
+	slog.Info("Слушатель остановлен", "listener", p.name)
 	return net.ErrClosed
 }
 
+// Shutdown перестаёт принимать соединения и ждёт, пока завершатся начатые обмены. Соединения, ожидающие
+// следующего запроса, закрываются сразу. Если ctx завершился раньше, оставшиеся соединения закрываются принудительно
 func (p *Proxy) Shutdown(ctx context.Context) error {
 	p.cancel()
 
+	p.mu.Lock()
+	p.draining = true
+	for conn := range p.conns {
+		if !conn.busy.Load() {
+			// будим соединения, которые ждут запрос клиента
+			_ = conn.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	p.mu.Unlock()
+	err := p.listener.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
 	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
@@ -88,9 +162,93 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 
 	// смотрим, что произошло раньше: завершение всех соединений или завершение контекста
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
 	case <-done:
 		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.cancel()
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (p *Proxy) track(conn net.Conn) (*trackedConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return nil, false
 	}
+	tracked := &trackedConn{Conn: conn, proxy: p}
+	// идентификатор соединения попадает в записи лога обо всех его обменах
+	tracked.ctx, tracked.cancel = context.WithCancel(logging.WithConnID(context.Background(), logging.NewID()))
+	p.conns[tracked] = struct{}{}
+	return tracked, true
+}
+
+func (p *Proxy) untrack(conn *trackedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+	conn.cancel()
+}
+
+func (p *Proxy) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
+
+// trackedConn - соединение клиента, которое знает, идёт ли по нему обмен: от первого байта запроса до EndExchange.
+// Во время остановки соединение без начатого обмена не может продлить ожидание чтения, поэтому обработчик
+// сразу выходит из цикла keep-alive, а начатый обмен успевает завершиться
+type trackedConn struct {
+	net.Conn
+	proxy *Proxy
+	busy  atomic.Bool
+	// отменяется при принудительном закрытии, чтобы прервать и обмен с сервером
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *trackedConn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.busy.Store(true)
+	}
+	return n, err
+}
+
+// EndExchange отмечает, что клиент получил окончательный ответ. Запись в соединение для этого не подходит:
+// промежуточные ответы 1xx (например, 100 Continue) отправляются посреди обмена
+func (c *trackedConn) EndExchange() {
+	c.busy.Store(false)
+}
+
+func (c *trackedConn) SetReadDeadline(t time.Time) error {
+	if !c.busy.Load() && c.proxy.isDraining() {
+		t = time.Now()
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *trackedConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// NetConn возвращает исходное соединение, например, для чтения SO_ORIGINAL_DST
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
 }
@@ -0,0 +1,102 @@
+package delivery
+
+import (
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type Rule struct {
+	rewriteUsecase usecase.RewriteUsecase
+	templates      map[string]*template.Template
+}
+
+func NewRuleDelivery(rewriteUC usecase.RewriteUsecase) (*Rule, error) {
+	d := Rule{
+		rewriteUsecase: rewriteUC,
+	}
+
+	d.templates = make(map[string]*template.Template)
+	tmpl, err := parseTemplate("rules.html")
+	if err != nil {
+		return nil, err
+	}
+	d.templates["rules"] = tmpl
+
+	return &d, nil
+}
+
+func (ru *Rule) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/rules", ru.RulesList)
+	mux.HandleFunc("/rules/add", ru.AddRule)
+	mux.HandleFunc("/rules/delete/", ru.DeleteRule)
+	mux.HandleFunc("/rules/toggle/", ru.ToggleRule)
+}
+
+func (ru *Rule) RulesList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := render(w, r, ru.templates["rules"], ru.rewriteUsecase.Rules())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Произошла внутренняя ошибка сервера: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (ru *Rule) AddRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rule := entity.RewriteRule{
+		Name:      r.FormValue("name"),
+		Enabled:   true,
+		Direction: entity.RuleDirection(r.FormValue("direction")),
+		Host:      strings.TrimSpace(r.FormValue("host")),
+		Path:      r.FormValue("path"),
+		Method:    strings.ToUpper(strings.TrimSpace(r.FormValue("method"))),
+		Action:    entity.RuleAction(r.FormValue("action")),
+		Header:    strings.TrimSpace(r.FormValue("header")),
+		Pattern:   r.FormValue("pattern"),
+		Value:     r.FormValue("value"),
+	}
+	err := ru.rewriteUsecase.AddRule(rule)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось добавить правило: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/rules", http.StatusSeeOther)
+}
+
+func (ru *Rule) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := ru.rewriteUsecase.DeleteRule(strings.TrimPrefix(r.URL.Path, "/rules/delete/"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось удалить правило: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/rules", http.StatusSeeOther)
+}
+
+func (ru *Rule) ToggleRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := ru.rewriteUsecase.ToggleRule(strings.TrimPrefix(r.URL.Path, "/rules/toggle/"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Не удалось изменить правило: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/rules", http.StatusSeeOther)
+}
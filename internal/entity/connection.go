@@ -0,0 +1,31 @@
+package entity
+
+import "time"
+
+// ConnectionInfo - сведения о соединениях, через которые прошёл обмен
+type ConnectionInfo struct {
+	ClientAddr string `bson:"client_addr,omitempty"` // адрес клиента прокси
+	// адрес, с которым установлено TCP-соединение: IP сервера или вышестоящего прокси
+	UpstreamAddr string   `bson:"upstream_addr,omitempty"`
+	TLS          *TLSInfo `bson:"tls,omitempty"` // параметры TLS-соединения с сервером
+}
+
+// TLSInfo - согласованные параметры TLS-соединения с сервером
+type TLSInfo struct {
+	Version      string            `bson:"version"`
+	CipherSuite  string            `bson:"cipher_suite"`
+	ALPN         string            `bson:"alpn,omitempty"`
+	SNI          string            `bson:"sni,omitempty"`
+	Certificates []CertificateInfo `bson:"certificates"` // цепочка сертификатов сервера, начиная с его собственного
+}
+
+type CertificateInfo struct {
+	Subject      string    `bson:"subject"`
+	Issuer       string    `bson:"issuer"`
+	SerialNumber string    `bson:"serial_number"`
+	DNSNames     []string  `bson:"dns_names,omitempty"`
+	NotBefore    time.Time `bson:"not_before"`
+	NotAfter     time.Time `bson:"not_after"`
+	SHA256       string    `bson:"sha256"` // отпечаток сертификата
+	PEM          string    `bson:"pem"`
+}
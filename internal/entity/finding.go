@@ -0,0 +1,65 @@
+package entity
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+type Severity string
+
+const (
+	SeverityInfo   Severity = "info"
+	SeverityLow    Severity = "low"
+	SeverityMedium Severity = "medium"
+	SeverityHigh   Severity = "high"
+)
+
+// Severities перечисляет уровни критичности от самого высокого к самому низкому
+var Severities = []Severity{SeverityHigh, SeverityMedium, SeverityLow, SeverityInfo}
+
+type Confidence string
+
+const (
+	ConfidenceCertain   Confidence = "certain"
+	ConfidenceFirm      Confidence = "firm"
+	ConfidenceTentative Confidence = "tentative"
+)
+
+type FindingStatus string
+
+const (
+	FindingStatusOpen          FindingStatus = "open"
+	FindingStatusFalsePositive FindingStatus = "false-positive"
+	FindingStatusFixed         FindingStatus = "fixed"
+)
+
+func (s FindingStatus) Valid() bool {
+	switch s {
+	case FindingStatusOpen, FindingStatusFalsePositive, FindingStatusFixed:
+		return true
+	}
+	return false
+}
+
+type Finding struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	HistoryID   string             `bson:"history_id" json:"history_id"` // запись истории, в которой проблема обнаружена впервые
+	Check       string             `bson:"check" json:"check"`           // идентификатор проверки, например "cookie-flags"
+	Title       string             `bson:"title" json:"title"`
+	Severity    Severity           `bson:"severity" json:"severity"`
+	Confidence  Confidence         `bson:"confidence" json:"confidence"`
+	Host        string             `bson:"host" json:"host"`
+	Path        string             `bson:"path" json:"path"`
+	Parameter   string             `bson:"parameter" json:"parameter"`
+	Evidence    string             `bson:"evidence" json:"evidence"`         // фрагмент запроса или ответа, подтверждающий находку
+	EvidenceIDs []string           `bson:"evidence_ids" json:"evidence_ids"` // записи истории с запросами, на которых воспроизводится находка
+	Status      FindingStatus      `bson:"status" json:"status"`
+	DateTime    string             `bson:"datetime" json:"datetime"`
+}
+
+type SeverityFindings struct {
+	Severity Severity
+	Findings []Finding
+}
+
+type HostFindings struct {
+	Host       string
+	Severities []SeverityFindings
+}
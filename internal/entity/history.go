@@ -32,10 +32,33 @@ type SerializableResponse struct {
 	Timestamp     time.Time      `bson:"timestamp"`
 }
 
+// HistoryMeta - сведения об обмене, которые нельзя получить из самих запроса и ответа
+type HistoryMeta struct {
+	AppliedRules []string        `bson:"applied_rules"`        // названия сработавших правил перезаписи
+	Passthrough  bool            `bson:"passthrough"`          // TLS-туннель не расшифровывался, сохранён только CONNECT
+	User         string          `bson:"user,omitempty"`       // пользователь прокси, от имени которого отправлен запрос
+	Error        string          `bson:"error,omitempty"`      // ошибка обмена с сервером, ответа в этом случае нет
+	Timing       *Timing         `bson:"timing,omitempty"`     // разбивка времени обмена с сервером по этапам
+	Connection   *ConnectionInfo `bson:"connection,omitempty"` // адреса и параметры TLS соединений обмена
+	Raw          *RawExchange    `bson:"raw,omitempty"`        // запрос и ответ в исходном виде
+	Stream       *Stream         `bson:"stream,omitempty"`     // события потокового ответа, тело в этом случае не сохраняется
+	// идентификаторы соединения клиента и обмена, с которыми обмен записан в лог
+	ConnID     string `bson:"conn_id,omitempty"`
+	ExchangeID string `bson:"exchange_id,omitempty"`
+}
+
+// RawExchange - байты запроса и ответа в том виде, в котором они прошли по сети:
+// запрос - как его прислал клиент, ответ - как его прислал сервер, до правил перезаписи и перехвата
+type RawExchange struct {
+	Request  []byte `bson:"request,omitempty"`
+	Response []byte `bson:"response,omitempty"`
+}
+
 type HistoryObject struct {
-	Request  SerializableRequest  `bson:"request"`
-	Response SerializableResponse `bson:"response"`
-	DateTime string               `bson:"datetime"`
+	Request     SerializableRequest  `bson:"request"`
+	Response    SerializableResponse `bson:"response"`
+	DateTime    string               `bson:"datetime"`
+	HistoryMeta `bson:",inline"`
 }
 
 type SerializablePair struct {
@@ -48,18 +71,30 @@ type ParamMinerObject struct {
 }
 
 type RequestListElem struct {
-	ID       string `template:"ID"`
-	DateTime string `template:"DateTime"`
+	ID       string `template:"ID" json:"id"`
+	DateTime string `template:"DateTime" json:"datetime"`
+	Method   string `template:"Method" json:"method"`
+	URL      string `template:"URL" json:"url"`
+	Status   int    `template:"Status" json:"status"` // 0 - ответа нет
+	User     string `template:"User" json:"user"`
+	Error    string `template:"Error" json:"error"`
 }
 
-func SerializeRequest(req *http.Request) (*SerializableRequest, error) {
-	var u string
+// RequestURL возвращает URL запроса в том виде, в котором он сохраняется в историю
+func RequestURL(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		// у CONNECT вместо URL только адрес хоста
+		return req.Host
+	}
 	if req.URL.Hostname() == "" {
 		// https запрос
-		u = fmt.Sprintf("https://%s%s", req.Host, req.URL.String())
-	} else {
-		u = req.URL.String()
+		return fmt.Sprintf("https://%s%s", req.Host, req.URL.String())
 	}
+	return req.URL.String()
+}
+
+func SerializeRequest(req *http.Request) (*SerializableRequest, error) {
+	u := RequestURL(req)
 
 	var body string
 	if req.Body != nil {
@@ -114,6 +149,11 @@ func DeserializeRequest(serializedReq SerializableRequest) (*http.Request, error
 }
 
 func SerializeResponse(res *http.Response) (*SerializableResponse, error) {
+	if res == nil {
+		// ответа может не быть, например, у нерасшифрованного туннеля
+		return &SerializableResponse{}, nil
+	}
+
 	var body string
 	if res.Body != nil {
 		buf, err := io.ReadAll(res.Body)
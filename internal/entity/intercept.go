@@ -0,0 +1,35 @@
+package entity
+
+import "time"
+
+// InterceptFilter определяет, какие сообщения останавливаются для ручного редактирования.
+// Пустые Host, Path и Method совпадают с любым значением
+type InterceptFilter struct {
+	Enabled   bool   `json:"enabled"`
+	Responses bool   `json:"responses"` // останавливать также и ответы
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	Method    string `json:"method"`
+}
+
+type InterceptedMessage struct {
+	ID        string        `json:"id"`
+	Direction RuleDirection `json:"direction"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Raw       string        `json:"raw"` // сообщение целиком в текстовом виде
+	Deadline  time.Time     `json:"deadline"`
+}
+
+type InterceptAction string
+
+const (
+	InterceptActionForward InterceptAction = "forward" // отправить дальше (возможно, отредактированным)
+	InterceptActionDrop    InterceptAction = "drop"    // разорвать соединение с клиентом
+	InterceptActionRespond InterceptAction = "respond" // ответить клиенту самостоятельно, не обращаясь к серверу
+)
+
+type InterceptDecision struct {
+	Action InterceptAction
+	Raw    string // отредактированное сообщение или собственный ответ
+}
@@ -0,0 +1,71 @@
+package entity
+
+import (
+	"strconv"
+	"strings"
+)
+
+type LiveEventType string
+
+const (
+	LiveEventHistory LiveEventType = "history" // в историю сохранён новый обмен
+	LiveEventScan    LiveEventType = "scan"    // ход сканирования
+)
+
+// LiveEvent - событие живой ленты web-интерфейса
+type LiveEvent struct {
+	Type    LiveEventType    `json:"type"`
+	Request *RequestListElem `json:"request,omitempty"`
+	Scan    *ScanProgress    `json:"scan,omitempty"`
+}
+
+type ScanKind string
+
+const (
+	ScanKindParams ScanKind = "params" // подбор параметров (param miner)
+	ScanKindActive ScanKind = "active" // активное сканирование
+)
+
+// ScanProgress - ход сканирования запроса из истории
+type ScanProgress struct {
+	Kind      ScanKind `json:"kind"`
+	HistoryID string   `json:"history_id"`
+	Done      int      `json:"done"`
+	Total     int      `json:"total"`
+}
+
+// LiveFilter - условия, по которым обмены попадают в живую ленту. Пустое поле выборку не ограничивает
+type LiveFilter struct {
+	URL        string `json:"url"`    // подстрока URL
+	Method     string `json:"method"` // метод без учёта регистра
+	Status     string `json:"status"` // код ответа (404) или класс кодов (4xx)
+	User       string `json:"user"`
+	ErrorsOnly bool   `json:"errors_only"` // только обмены, завершившиеся ошибкой
+}
+
+// Match проверяет, подходит ли обмен под фильтр
+func (f LiveFilter) Match(elem RequestListElem) bool {
+	if f.URL != "" && !strings.Contains(strings.ToLower(elem.URL), strings.ToLower(f.URL)) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(elem.Method, f.Method) {
+		return false
+	}
+	if f.User != "" && elem.User != f.User {
+		return false
+	}
+	if f.ErrorsOnly && elem.Error == "" {
+		return false
+	}
+	return f.matchStatus(elem.Status)
+}
+
+func (f LiveFilter) matchStatus(status int) bool {
+	if f.Status == "" {
+		return true
+	}
+	if class, ok := strings.CutSuffix(strings.ToLower(f.Status), "xx"); ok {
+		return class == strconv.Itoa(status/100)
+	}
+	return f.Status == strconv.Itoa(status)
+}
@@ -0,0 +1,104 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type RuleDirection string
+
+const (
+	RuleDirectionRequest  RuleDirection = "request"
+	RuleDirectionResponse RuleDirection = "response"
+)
+
+type RuleAction string
+
+const (
+	RuleActionAddHeader     RuleAction = "add-header"     // добавить значение заголовка Header = Value
+	RuleActionRemoveHeader  RuleAction = "remove-header"  // удалить заголовок Header
+	RuleActionReplaceHeader RuleAction = "replace-header" // заменить Pattern на Value в значениях заголовка Header (без Pattern - перезаписать целиком)
+	RuleActionReplaceURL    RuleAction = "replace-url"    // заменить Pattern на Value в URL запроса
+	RuleActionReplaceBody   RuleAction = "replace-body"   // заменить Pattern на Value в теле
+	RuleActionSetStatus     RuleAction = "set-status"     // переопределить код ответа значением Value
+)
+
+// RewriteRule описывает одно изменение запроса или ответа. Пустые Host, Path и Method совпадают с любым значением
+type RewriteRule struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Enabled   bool          `json:"enabled"`
+	Direction RuleDirection `json:"direction"`
+	Host      string        `json:"host,omitempty"`   // шаблон хоста, например *.example.com
+	Path      string        `json:"path,omitempty"`   // регулярное выражение для пути
+	Method    string        `json:"method,omitempty"` // HTTP-метод запроса
+	Action    RuleAction    `json:"action"`
+	Header    string        `json:"header,omitempty"`
+	Pattern   string        `json:"pattern,omitempty"` // регулярное выражение для replace-* действий
+	Value     string        `json:"value,omitempty"`
+}
+
+// Validate проверяет, что действие подходит к направлению правила, а выражения и код ответа корректны
+func (r RewriteRule) Validate() error {
+	if r.Direction != RuleDirectionRequest && r.Direction != RuleDirectionResponse {
+		return fmt.Errorf("неизвестное направление: %s", r.Direction)
+	}
+
+	switch r.Action {
+	case RuleActionAddHeader, RuleActionRemoveHeader, RuleActionReplaceHeader:
+		if r.Header == "" {
+			return errors.New("не указан заголовок")
+		}
+	case RuleActionReplaceURL:
+		if r.Direction != RuleDirectionRequest {
+			return errors.New("URL можно изменить только в запросе")
+		}
+	case RuleActionReplaceBody:
+	case RuleActionSetStatus:
+		if r.Direction != RuleDirectionResponse {
+			return errors.New("код ответа можно изменить только в ответе")
+		}
+		code, err := strconv.Atoi(r.Value)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("некорректный код ответа: %s", r.Value)
+		}
+	default:
+		return fmt.Errorf("неизвестное действие: %s", r.Action)
+	}
+
+	if r.Path != "" {
+		if _, err := regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("некорректное выражение для пути: %s", err)
+		}
+	}
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("некорректное выражение для замены: %s", err)
+		}
+	}
+	if r.Pattern == "" && (r.Action == RuleActionReplaceURL || r.Action == RuleActionReplaceBody) {
+		return errors.New("не указано выражение для замены")
+	}
+	return nil
+}
+
+// MatchHostPattern проверяет хост на соответствие шаблону, в котором * заменяет любую последовательность символов.
+// Порт в хосте не учитывается
+func MatchHostPattern(pattern, host string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.Contains(pattern, "*") {
+		return strings.EqualFold(pattern, host)
+	}
+	expr := "^(?i)" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, err := regexp.MatchString(expr, host)
+	return err == nil && matched
+}
@@ -0,0 +1,35 @@
+package entity
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ScopeRule описывает часть цели. Пустые поля совпадают с любым значением
+type ScopeRule struct {
+	Scheme string `json:"scheme,omitempty"` // http или https
+	Host   string `json:"host,omitempty"`   // шаблон хоста, например *.example.com
+	Port   string `json:"port,omitempty"`
+	Path   string `json:"path,omitempty"` // регулярное выражение для пути
+}
+
+// Validate проверяет схему и выражение для пути
+func (r ScopeRule) Validate() error {
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, "http") && !strings.EqualFold(r.Scheme, "https") {
+		return fmt.Errorf("схема %q не поддерживается, допустимы: http, https", r.Scheme)
+	}
+	if r.Path != "" {
+		if _, err := regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("некорректное выражение для пути %q: %s", r.Path, err)
+		}
+	}
+	return nil
+}
+
+// Scope определяет цель тестирования: URL входит в неё, если совпадает хотя бы с одним правилом Include
+// и ни с одним правилом Exclude. Пустой Include означает, что в цель входит весь трафик
+type Scope struct {
+	Include []ScopeRule `json:"include"`
+	Exclude []ScopeRule `json:"exclude"`
+}
@@ -0,0 +1,11 @@
+package entity
+
+import "time"
+
+// Session - сессия пользователя веб-интерфейса. CSRFToken должен приходить вместе с каждым изменяющим запросом
+type Session struct {
+	ID        string
+	User      string
+	CSRFToken string
+	Expires   time.Time
+}
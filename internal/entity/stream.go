@@ -0,0 +1,30 @@
+package entity
+
+import (
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Stream - события потокового ответа, который передаётся клиенту по мере получения. Для Server-Sent Events это
+// разобранные события, для остальных потоков (длинный опрос, NDJSON, multipart/x-mixed-replace) - части тела
+type Stream struct {
+	Open   bool          `bson:"open" json:"open"`                       // сервер ещё передаёт события
+	Error  string        `bson:"error,omitempty" json:"error,omitempty"` // причина, по которой поток прервался
+	Events []StreamEvent `bson:"events" json:"events"`
+}
+
+// StreamEvent - событие потока с моментом его получения от сервера
+type StreamEvent struct {
+	Time  time.Time `bson:"time" json:"time"`
+	ID    string    `bson:"id,omitempty" json:"id,omitempty"`
+	Event string    `bson:"event,omitempty" json:"event,omitempty"`
+	Data  string    `bson:"data" json:"data"`
+}
+
+// IsEventStream проверяет, является ли ответ потоком Server-Sent Events: такое тело не заканчивается,
+// пока сервер или клиент не закроют соединение, поэтому его не нужно пытаться дочитать
+func IsEventStream(res *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
@@ -0,0 +1,21 @@
+package entity
+
+import "time"
+
+// Timeouts - ограничения времени для соединений прокси. Нулевое значение отключает соответствующий таймаут
+type Timeouts struct {
+	Idle           time.Duration // ожидание следующего запроса в keep-alive соединении клиента
+	ReadHeader     time.Duration // чтение заголовков запроса клиента
+	Read           time.Duration // чтение запроса клиента целиком, вместе с телом
+	Write          time.Duration // отправка ответа клиенту
+	Dial           time.Duration // подключение к серверу, включая рукопожатия с вышестоящим прокси и TLS
+	ResponseHeader time.Duration // ожидание заголовков ответа сервера после отправки запроса
+}
+
+// Deadline возвращает момент истечения таймаута d, отсчитанного от текущего времени, или нулевое время, если d не задан
+func Deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
@@ -0,0 +1,53 @@
+package entity
+
+import "time"
+
+// TimingPhase - этап обмена с сервером: смещение от начала обмена и длительность
+type TimingPhase struct {
+	Start    time.Duration `bson:"start"`
+	Duration time.Duration `bson:"duration"`
+}
+
+// Timing - разбивка времени обмена с сервером по этапам. Этапы, которых не было
+// (например, DNS и подключение при повторном использовании соединения), остаются нулевыми
+type Timing struct {
+	DNS      TimingPhase   `bson:"dns"`
+	Connect  TimingPhase   `bson:"connect"`
+	TLS      TimingPhase   `bson:"tls"`
+	TTFB     TimingPhase   `bson:"ttfb"`     // от отправки запроса до первого байта ответа
+	Transfer TimingPhase   `bson:"transfer"` // от первого до последнего байта ответа
+	Total    time.Duration `bson:"total"`
+}
+
+// WaterfallBar - строка диаграммы этапов обмена, смещение и ширина указаны в процентах от общего времени
+type WaterfallBar struct {
+	Name     string
+	Duration time.Duration
+	Offset   float64
+	Width    float64
+}
+
+// Waterfall возвращает этапы обмена в порядке их выполнения для отображения в виде диаграммы
+func (t *Timing) Waterfall() []WaterfallBar {
+	phases := []struct {
+		name  string
+		phase TimingPhase
+	}{
+		{"DNS", t.DNS},
+		{"Connect", t.Connect},
+		{"TLS", t.TLS},
+		{"TTFB", t.TTFB},
+		{"Transfer", t.Transfer},
+	}
+
+	bars := make([]WaterfallBar, 0, len(phases))
+	for _, p := range phases {
+		bar := WaterfallBar{Name: p.name, Duration: p.phase.Duration}
+		if t.Total > 0 {
+			bar.Offset = 100 * float64(p.phase.Start) / float64(t.Total)
+			bar.Width = 100 * float64(p.phase.Duration) / float64(t.Total)
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
@@ -0,0 +1,88 @@
+// Package logging настраивает slog и передаёт через контекст идентификаторы соединения и обмена,
+// которые попадают в каждую запись лога и в историю: по ним запись лога связывается с сохранённым запросом
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// New создаёт логгер, пишущий в w записи не ниже level: в JSON при json, иначе в текстовом виде key=value.
+// Чтобы менять уровень на ходу, можно передать *slog.LevelVar
+func New(w io.Writer, level slog.Leveler, json bool) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if json {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// ParseLevel разбирает уровень логирования: debug, info, warn или error
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.TrimSpace(value)))
+	if err != nil {
+		return 0, fmt.Errorf("неизвестный уровень логирования %q", value)
+	}
+	return level, nil
+}
+
+// contextHandler дополняет записи идентификаторами из контекста, переданного в *Context-методы логгера
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := ConnID(ctx); id != "" {
+		record.AddAttrs(slog.String("conn_id", id))
+	}
+	if id := ExchangeID(ctx); id != "" {
+		record.AddAttrs(slog.String("exchange_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type connIDKey struct{}
+
+type exchangeIDKey struct{}
+
+// NewID возвращает случайный идентификатор для соединения или обмена
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithConnID добавляет в контекст идентификатор соединения клиента
+func WithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+func ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+// WithExchangeID добавляет в контекст идентификатор обмена: запроса клиента и ответа на него
+func WithExchangeID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, exchangeIDKey{}, id)
+}
+
+func ExchangeID(ctx context.Context) string {
+	id, _ := ctx.Value(exchangeIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"strings"
+	"sync"
+)
+
+// OtherHost - значение метки host для хостов, запросы к которым не считаются по отдельности
+const OtherHost = "other"
+
+// maxHosts ограничивает число хостов со своими сериями, когда список хостов не задан: пустой scope включает
+// весь трафик, и без ограничения каждый новый хост навсегда добавлял бы в выдачу новые серии
+const maxHosts = 100
+
+var hosts = &hostLabels{seen: make(map[string]struct{})}
+
+// hostLabels выбирает значение метки host
+type hostLabels struct {
+	mu       sync.Mutex
+	patterns []string
+	seen     map[string]struct{}
+}
+
+// SetHosts задаёт шаблоны хостов (например, *.example.com), запросы к которым считаются по отдельности.
+// При пустом списке по отдельности считаются хосты из scope, но не больше maxHosts
+func SetHosts(patterns []string) {
+	hosts.mu.Lock()
+	defer hosts.mu.Unlock()
+	hosts.patterns = append([]string(nil), patterns...)
+}
+
+// HostLabel возвращает значение метки host для запроса к host, inScope - попадает ли запрос в scope
+func HostLabel(host string, inScope bool) string {
+	host = strings.ToLower(host)
+	hosts.mu.Lock()
+	defer hosts.mu.Unlock()
+	if len(hosts.patterns) > 0 {
+		for _, pattern := range hosts.patterns {
+			if entity.MatchHostPattern(pattern, host) {
+				return host
+			}
+		}
+		return OtherHost
+	}
+	if !inScope || host == "" {
+		return OtherHost
+	}
+	if _, ok := hosts.seen[host]; ok {
+		return host
+	}
+	if len(hosts.seen) >= maxHosts {
+		return OtherHost
+	}
+	hosts.seen[host] = struct{}{}
+	return host
+}
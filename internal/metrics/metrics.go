@@ -0,0 +1,31 @@
+// Package metrics собирает метрики прокси и отдаёт их в формате Prometheus.
+// Метрики объявлены на уровне пакета, как логгер slog по умолчанию: их обновляют слои, которые ничего не знают друг о друге
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// DefaultBuckets - границы корзин гистограмм длительности в секундах
+var DefaultBuckets = prometheus.DefBuckets
+
+// Registry содержит метрики прокси, а также метрики среды выполнения Go и процесса
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler отдаёт метрики по HTTP
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Метрики слушателей прокси
+var (
+	ActiveConnections = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mitm_proxy_active_connections",
+		Help: "Открытые соединения клиентов",
+	}, []string{"listener"})
+	Connections = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mitm_proxy_connections_total",
+		Help: "Принятые соединения клиентов",
+	}, []string{"listener"})
+)
+
+// Метрики обменов с серверами. Значение метки host выбирает HostLabel, чтобы число серий оставалось ограниченным
+var (
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mitm_proxy_requests_total",
+		Help: "Запросы клиентов по хосту (other - хосты вне scope или списка metrics.hosts) и статусу ответа сервера или прокси, если обмен с сервером не удался",
+	}, []string{"host", "status"})
+	UpstreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mitm_proxy_upstream_duration_seconds",
+		Help:    "Длительность этапов обмена с сервером: dns, connect, tls, ttfb, transfer и total",
+		Buckets: DefaultBuckets,
+	}, []string{"phase"})
+)
+
+// Метрики сертификатов, которые прокси выпускает для хостов
+var (
+	CertCacheHits = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mitm_proxy_cert_cache_hits_total",
+		Help: "Сертификаты, найденные в хранилище",
+	})
+	CertCacheMisses = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mitm_proxy_cert_cache_misses_total",
+		Help: "Сертификаты, которых не было в хранилище",
+	})
+	CertGenerations = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mitm_proxy_cert_generations_total",
+		Help: "Выпущенные сертификаты",
+	}, []string{"result"})
+)
+
+// Метрики хранилища
+var (
+	StorageWriteDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mitm_proxy_storage_write_duration_seconds",
+		Help:    "Длительность записи в хранилище",
+		Buckets: DefaultBuckets,
+	}, []string{"operation"})
+	StorageWriteFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mitm_proxy_storage_write_failures_total",
+		Help: "Неудачные записи в хранилище",
+	}, []string{"operation"})
+)
+
+// Метрики инструментов сканирования
+var (
+	ScanJobs = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "mitm_proxy_scan_jobs_total",
+		Help: "Завершённые задачи сканирования по виду и результату (ok или error)",
+	}, []string{"kind", "result"})
+	ScanJobsRunning = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mitm_proxy_scan_jobs_running",
+		Help: "Выполняющиеся задачи сканирования",
+	}, []string{"kind"})
+)
+
+// ObserveStorageWrite учитывает запись в хранилище, начатую в start и завершившуюся с ошибкой err
+func ObserveStorageWrite(operation string, start time.Time, err error) {
+	StorageWriteDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StorageWriteFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+// StartScan учитывает запуск задачи сканирования вида kind и возвращает функцию, которую нужно вызвать по её окончании
+func StartScan(kind string) func(err error) {
+	ScanJobsRunning.WithLabelValues(kind).Inc()
+	return func(err error) {
+		ScanJobsRunning.WithLabelValues(kind).Dec()
+		ScanJobs.WithLabelValues(kind, Result(err)).Inc()
+	}
+}
+
+// Result возвращает значение метки result для операции, завершившейся с ошибкой err
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
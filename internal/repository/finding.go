@@ -0,0 +1,11 @@
+package repository
+
+import "github.com/blackHATred/mitm_proxy/internal/entity"
+
+type Finding interface {
+	AddFindings(findings []entity.Finding) error
+	GetFinding(id string) (*entity.Finding, error)
+	GetFindingsByHistoryID(id string) ([]entity.Finding, error)
+	GetAllFindings() ([]entity.Finding, error)
+	UpdateFindingStatus(id string, status entity.FindingStatus) error
+}
@@ -10,7 +10,11 @@ import (
 type History interface {
 	GenerateCertificate(host string) (*tls.Certificate, error)
 	GetCertificate(host string) (*tls.Certificate, error)
-	AddHistory(req *http.Request, res *http.Response) (primitive.ObjectID, error)
+	AddHistory(req *http.Request, res *http.Response, meta entity.HistoryMeta) (primitive.ObjectID, error)
 	GetHistoryObject(id string) (*entity.HistoryObject, error)
+	// FindByExchangeID возвращает id записи истории по идентификатору обмена из лога или пустую строку, если записи нет
+	FindByExchangeID(exchangeID string) (string, error)
 	GetAllHistory() ([]entity.RequestListElem, error)
+	AppendStreamEvents(id primitive.ObjectID, events []entity.StreamEvent) error
+	CloseStream(id primitive.ObjectID, streamErr string) error
 }
@@ -0,0 +1,135 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
+	"github.com/blackHATred/mitm_proxy/internal/repository"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type findingDB struct {
+	db  *mongo.Database
+	ctx context.Context
+}
+
+func NewFindingRepository(db *mongo.Database) repository.Finding {
+	return &findingDB{
+		db:  db,
+		ctx: context.Background(),
+	}
+}
+
+func (f *findingDB) AddFindings(findings []entity.Finding) error {
+	if len(findings) == 0 {
+		return nil
+	}
+
+	// одна и та же проблема на одном и том же месте хранится одной записью, к которой копятся доказательства
+	models := make([]mongo.WriteModel, 0, 2*len(findings))
+	for _, finding := range findings {
+		evidenceIDs := finding.EvidenceIDs
+		if evidenceIDs == nil {
+			evidenceIDs = []string{}
+		}
+		filter := bson.M{
+			"check":     finding.Check,
+			"host":      finding.Host,
+			"path":      finding.Path,
+			"parameter": finding.Parameter,
+			"title":     finding.Title,
+		}
+		// исправленная проблема, найденная снова, опять открыта. Ложное срабатывание остаётся ложным
+		reopen := bson.M{"status": entity.FindingStatusFixed}
+		for key, value := range filter {
+			reopen[key] = value
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(reopen).
+			SetUpdate(bson.M{"$set": bson.M{"status": entity.FindingStatusOpen}}))
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{
+					"history_id": finding.HistoryID,
+					"severity":   finding.Severity,
+					"confidence": finding.Confidence,
+					"evidence":   finding.Evidence,
+					"status":     entity.FindingStatusOpen,
+					"datetime":   finding.DateTime,
+				},
+				"$addToSet": bson.M{"evidence_ids": bson.M{"$each": evidenceIDs}},
+			}).
+			SetUpsert(true))
+	}
+	start := time.Now()
+	_, err := f.db.Collection("findings").BulkWrite(f.ctx, models, options.BulkWrite().SetOrdered(false))
+	metrics.ObserveStorageWrite("add_findings", start, err)
+	if err != nil {
+		return fmt.Errorf("ошибка записи находок в базу данных: %s", err)
+	}
+	return nil
+}
+
+func (f *findingDB) GetFinding(id string) (*entity.Finding, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var finding entity.Finding
+	err = f.db.Collection("findings").FindOne(f.ctx, bson.M{"_id": objID}).Decode(&finding)
+	if err != nil {
+		return nil, err
+	}
+	return &finding, nil
+}
+
+func (f *findingDB) GetFindingsByHistoryID(id string) ([]entity.Finding, error) {
+	return f.find(bson.M{"$or": bson.A{
+		bson.M{"history_id": id},
+		bson.M{"evidence_ids": id},
+	}})
+}
+
+func (f *findingDB) GetAllFindings() ([]entity.Finding, error) {
+	return f.find(bson.M{})
+}
+
+func (f *findingDB) find(filter bson.M) ([]entity.Finding, error) {
+	cursor, err := f.db.Collection("findings").Find(f.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := make([]entity.Finding, 0)
+	err = cursor.All(f.ctx, &findings)
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func (f *findingDB) UpdateFindingStatus(id string, status entity.FindingStatus) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	result, err := f.db.Collection("findings").UpdateOne(f.ctx, bson.M{"_id": objID}, bson.M{"$set": bson.M{"status": status}})
+	metrics.ObserveStorageWrite("update_finding_status", start, err)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления статуса находки: %s", err)
+	}
+	if result.MatchedCount == 0 {
+		return errors.New("находка не найдена")
+	}
+	return nil
+}
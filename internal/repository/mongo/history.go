@@ -12,10 +12,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
 	"github.com/blackHATred/mitm_proxy/internal/repository"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"math/big"
 	"net"
 	"net/http"
@@ -140,8 +142,10 @@ func (h *historyDB) GetCertificate(host string) (*tls.Certificate, error) {
 	var certData bson.M
 	err := h.db.Collection("certificates").FindOne(h.ctx, bson.M{"host": host}).Decode(&certData)
 	if errors.Is(err, mongo.ErrNoDocuments) {
+		metrics.CertCacheMisses.Inc()
 		// если сертификат не найден, генерируем новый
 		cert, err := h.GenerateCertificate(host)
+		metrics.CertGenerations.WithLabelValues(metrics.Result(err)).Inc()
 		if err != nil {
 			return nil, fmt.Errorf("ошибка генерации сертификата: %s", err)
 		}
@@ -164,11 +168,13 @@ func (h *historyDB) GetCertificate(host string) (*tls.Certificate, error) {
 		})
 
 		// сохраняем сертификат и ключ в базу данных
+		start := time.Now()
 		_, err = h.db.Collection("certificates").InsertOne(h.ctx, bson.M{
 			"host":    host,
 			"certPEM": string(certPEM),
 			"keyPEM":  string(keyPEM),
 		})
+		metrics.ObserveStorageWrite("insert_certificate", start, err)
 		if err != nil {
 			return nil, fmt.Errorf("ошибка записи сертификата в базу данных: %s", err)
 		}
@@ -178,6 +184,8 @@ func (h *historyDB) GetCertificate(host string) (*tls.Certificate, error) {
 		return nil, fmt.Errorf("ошибка поиска сертификата в базе данных: %s", err)
 	}
 
+	metrics.CertCacheHits.Inc()
+
 	// десериализуем сертификат и ключ из PEM-формата
 	certPEM := certData["certPEM"].(string)
 	keyPEM := certData["keyPEM"].(string)
@@ -191,7 +199,7 @@ func (h *historyDB) GetCertificate(host string) (*tls.Certificate, error) {
 	return &tlsCert, nil
 }
 
-func (h *historyDB) AddHistory(req *http.Request, res *http.Response) (primitive.ObjectID, error) {
+func (h *historyDB) AddHistory(req *http.Request, res *http.Response, meta entity.HistoryMeta) (primitive.ObjectID, error) {
 	serializedReq, err := entity.SerializeRequest(req)
 	if err != nil {
 		return primitive.NilObjectID, err
@@ -201,11 +209,14 @@ func (h *historyDB) AddHistory(req *http.Request, res *http.Response) (primitive
 		return primitive.NilObjectID, err
 	}
 	historyObject := entity.HistoryObject{
-		Request:  *serializedReq,
-		Response: *serializedRes,
-		DateTime: time.Now().Format(time.RFC3339),
+		Request:     *serializedReq,
+		Response:    *serializedRes,
+		DateTime:    time.Now().Format(time.RFC3339),
+		HistoryMeta: meta,
 	}
+	start := time.Now()
 	result, err := h.db.Collection("history").InsertOne(h.ctx, historyObject)
+	metrics.ObserveStorageWrite("add_history", start, err)
 	if err != nil {
 		return primitive.NilObjectID, fmt.Errorf("ошибка записи в базу данных: %s", err)
 	}
@@ -227,25 +238,93 @@ func (h *historyDB) GetHistoryObject(id string) (*entity.HistoryObject, error) {
 	return &historyObject, err
 }
 
+func (h *historyDB) FindByExchangeID(exchangeID string) (string, error) {
+	var result struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err := h.db.Collection("history").FindOne(h.ctx, bson.M{"exchange_id": exchangeID},
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return result.ID.Hex(), nil
+}
+
 func (h *historyDB) GetAllHistory() ([]entity.RequestListElem, error) {
-	cursor, err := h.db.Collection("history").Find(h.ctx, bson.M{})
+	// для списка тела запросов и ответов не нужны, а они могут быть большими
+	projection := bson.M{
+		"datetime":             1,
+		"user":                 1,
+		"error":                1,
+		"request.method":       1,
+		"request.url":          1,
+		"response.status_code": 1,
+	}
+	cursor, err := h.db.Collection("history").Find(h.ctx, bson.M{}, options.Find().SetProjection(projection))
 	if err != nil {
 		return nil, err
 	}
 
-	var historyBSON []bson.M
-	err = cursor.All(h.ctx, &historyBSON)
+	// у записей, сохранённых без аутентификации на прокси, без ошибки или без ответа, части полей нет
+	var historyList []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		DateTime string             `bson:"datetime"`
+		User     string             `bson:"user"`
+		Error    string             `bson:"error"`
+		Request  struct {
+			Method string `bson:"method"`
+			URL    string `bson:"url"`
+		} `bson:"request"`
+		Response struct {
+			StatusCode int `bson:"status_code"`
+		} `bson:"response"`
+	}
+	err = cursor.All(h.ctx, &historyList)
 	if err != nil {
 		return nil, err
 	}
 
-	data := make([]entity.RequestListElem, len(historyBSON))
-	for i, elem := range historyBSON {
+	data := make([]entity.RequestListElem, len(historyList))
+	for i, elem := range historyList {
 		data[i] = entity.RequestListElem{
-			ID:       elem["_id"].(primitive.ObjectID).Hex(),
-			DateTime: elem["datetime"].(string),
+			ID:       elem.ID.Hex(),
+			DateTime: elem.DateTime,
+			Method:   elem.Request.Method,
+			URL:      elem.Request.URL,
+			Status:   elem.Response.StatusCode,
+			User:     elem.User,
+			Error:    elem.Error,
 		}
 	}
 
 	return data, nil
 }
+
+func (h *historyDB) AppendStreamEvents(id primitive.ObjectID, events []entity.StreamEvent) error {
+	start := time.Now()
+	_, err := h.db.Collection("history").UpdateOne(h.ctx, bson.M{"_id": id}, bson.M{
+		"$push": bson.M{"stream.events": bson.M{"$each": events}},
+	})
+	metrics.ObserveStorageWrite("append_stream_events", start, err)
+	if err != nil {
+		return fmt.Errorf("ошибка записи в базу данных: %s", err)
+	}
+	return nil
+}
+
+func (h *historyDB) CloseStream(id primitive.ObjectID, streamErr string) error {
+	set := bson.M{"stream.open": false}
+	if streamErr != "" {
+		set["stream.error"] = streamErr
+	}
+	start := time.Now()
+	_, err := h.db.Collection("history").UpdateOne(h.ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	metrics.ObserveStorageWrite("close_stream", start, err)
+	if err != nil {
+		return fmt.Errorf("ошибка записи в базу данных: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package usecase
+
+import "github.com/blackHATred/mitm_proxy/internal/entity"
+
+type FindingUsecase interface {
+	FindingDashboard() ([]entity.HostFindings, error)
+	SetFindingStatus(id string, status entity.FindingStatus) error
+	ExportFindings(format string) ([]byte, string, error)
+}
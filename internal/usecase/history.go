@@ -2,15 +2,36 @@ package usecase
 
 import (
 	"crypto/tls"
+	"errors"
 	"github.com/blackHATred/mitm_proxy/internal/entity"
 	"net/http"
 )
 
+// ErrNoRawRequest возвращается при повторе исходных байтов запроса, для которого они не сохранены
+var ErrNoRawRequest = errors.New("для запроса не сохранены исходные байты")
+
+// ErrExchangeNotFound возвращается, если в истории нет обмена с указанным идентификатором
+var ErrExchangeNotFound = errors.New("обмен с таким идентификатором не найден")
+
 type HistoryUsecase interface {
-	RequestRepeat(id string) (string, error)
+	// RequestRepeat повторяет запрос и возвращает id нового обмена. При raw на сервер отправляются
+	// сохранённые байты запроса как есть, без разбора и нормализации
+	RequestRepeat(id string, raw bool) (string, error)
 	RequestDetails(id string) (*entity.HistoryObject, error)
+	// FindByExchangeID возвращает id записи истории по идентификатору обмена, с которым он записан в лог
+	FindByExchangeID(exchangeID string) (string, error)
+	// LoadParams заменяет словарь параметров для param miner словарём из файла
+	LoadParams(filename string) error
 	RequestScan(id string) (*entity.ParamMinerObject, error)
 	RequestList() ([]entity.RequestListElem, error)
-	AddHistory(req *http.Request, res *http.Response) error
+	// AddHistory сохраняет обмен и возвращает его id
+	AddHistory(req *http.Request, res *http.Response, meta entity.HistoryMeta) (string, error)
+	// AddStream сохраняет обмен с потоковым ответом без тела и возвращает его id:
+	// события потока добавляются через AppendStreamEvents по мере получения, а CloseStream отмечает его конец
+	AddStream(req *http.Request, res *http.Response, meta entity.HistoryMeta) (string, error)
+	AppendStreamEvents(id string, events []entity.StreamEvent) error
+	CloseStream(id string, streamErr error) error
+	// StreamEvents возвращает состояние потока и его события, начиная с from-го
+	StreamEvents(id string, from int) (*entity.Stream, error)
 	GetCertificate(host string) (*tls.Certificate, error)
 }
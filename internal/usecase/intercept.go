@@ -0,0 +1,18 @@
+package usecase
+
+import (
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net/http"
+)
+
+var ErrInterceptDropped = errors.New("сообщение отброшено пользователем")
+
+type InterceptUsecase interface {
+	InterceptRequest(req *http.Request) (*http.Request, *http.Response, error)
+	InterceptResponse(req *http.Request, res *http.Response) (*http.Response, error)
+	Pending() []entity.InterceptedMessage
+	Resolve(id string, decision entity.InterceptDecision) error
+	Filter() entity.InterceptFilter
+	SetFilter(filter entity.InterceptFilter) error
+}
@@ -0,0 +1,11 @@
+package usecase
+
+import "github.com/blackHATred/mitm_proxy/internal/entity"
+
+// LiveUsecase рассылает подписчикам живой ленты события о новых обменах и ходе сканирования
+type LiveUsecase interface {
+	Publish(event entity.LiveEvent)
+	// Subscribe возвращает канал событий, подходящих под filter, и функцию отписки. Подписчик, который не успевает
+	// читать события, пропускает их: рассылка не должна задерживать прокси
+	Subscribe(filter entity.LiveFilter) (<-chan entity.LiveEvent, func())
+}
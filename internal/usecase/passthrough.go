@@ -0,0 +1,10 @@
+package usecase
+
+type PassthroughUsecase interface {
+	Passthrough(host string) bool
+	ReportHandshakeFailure(host string, err error)
+	// ReportHandshakeSuccess сообщает, что клиент принял поддельный сертификат host
+	ReportHandshakeSuccess(host string)
+	// Configure задаёт хосты, для которых TLS не расшифровывается, и число отказов до автоматического passthrough
+	Configure(patterns []string, threshold int)
+}
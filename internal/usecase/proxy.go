@@ -2,6 +2,7 @@ package usecase
 
 import (
 	"crypto/tls"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
 	"net"
 	"net/http"
 )
@@ -10,6 +11,12 @@ type ProxyUsecase interface {
 	HandleConn(conn net.Conn) error
 	GetTLSConfig(host string) (*tls.Config, error)
 	HandleHTTPSConnect(conn net.Conn, req *http.Request) error
-	HandleHTTPRequest(conn net.Conn, request *http.Request, tlsCfg *tls.Config) error
-	SendRequest(dial net.Conn, req *http.Request) (*http.Response, error)
+	HandleSocksConn(conn net.Conn) error
+	HandleTransparentConn(conn net.Conn) error
+	HandleStream(conn net.Conn, addr string) error
+	HandleHTTPRequest(conn net.Conn, request *http.Request) (bool, error)
+	Tunnel(conn net.Conn, addr string) error
+	// SendRequest отправляет запрос в dial и читает ответ. При непустом forward dial - соединение
+	// с вышестоящим HTTP-прокси, и запрос отправляется ему в абсолютной форме
+	SendRequest(dial net.Conn, req *http.Request, forward *entity.ForwardProxy) (*http.Response, error)
 }
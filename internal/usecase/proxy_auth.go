@@ -0,0 +1,6 @@
+package usecase
+
+type ProxyAuthUsecase interface {
+	Enabled() bool
+	Authenticate(username, password string) bool
+}
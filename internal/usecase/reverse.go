@@ -0,0 +1,7 @@
+package usecase
+
+import "net"
+
+type ReverseUsecase interface {
+	HandleConn(conn net.Conn) error
+}
@@ -0,0 +1,18 @@
+package usecase
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net/http"
+)
+
+type RewriteUsecase interface {
+	ApplyRequest(req *http.Request) ([]string, error)
+	ApplyResponse(req *http.Request, res *http.Response) ([]string, error)
+	Rules() []entity.RewriteRule
+	AddRule(rule entity.RewriteRule) error
+	DeleteRule(id string) error
+	ToggleRule(id string) error
+	// Reload заменяет правила правилами rules из конфигурации и правилами из файла filename. Изменения
+	// из веб-интерфейса сохраняются в этот файл, правила из конфигурации в него не попадают
+	Reload(rules []entity.RewriteRule, filename string) error
+}
@@ -0,0 +1,12 @@
+package usecase
+
+import "github.com/blackHATred/mitm_proxy/internal/entity"
+
+type ScannerUsecase interface {
+	PassiveScan(id string) ([]entity.Finding, error)
+	ActiveScan(id string) ([]entity.Finding, error)
+	HistoryFindings(id string) ([]entity.Finding, error)
+	// SetHistoryUsecase задаёт usecase истории, через который сохраняются запросы-доказательства активного
+	// сканирования. Usecase истории сам зависит от сканера, поэтому их связывают после создания обоих
+	SetHistoryUsecase(historyUC HistoryUsecase)
+}
@@ -0,0 +1,17 @@
+package usecase
+
+import (
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net/url"
+)
+
+var ErrOutOfScope = errors.New("цель не входит в scope")
+
+type ScopeUsecase interface {
+	InScope(u *url.URL) bool
+	InScopeHost(scheme, hostport string) bool
+	CheckURL(rawURL string) error
+	// Reload заменяет правила scope правилами из scope, за которыми следуют правила из файла filename (если он задан)
+	Reload(scope entity.Scope, filename string) error
+}
@@ -0,0 +1,583 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	locationQuery  = "query"
+	locationBody   = "body"
+	locationCookie = "cookie"
+	locationHeader = "header"
+
+	// задержка, которую запрашивают time-based пейлоады
+	sleepSeconds = 5
+	// допуск при сравнении длительности ответа с ожидаемой задержкой
+	sleepThreshold = sleepSeconds*time.Second - 500*time.Millisecond
+	// ограничение на один запрос сканера: time-based пейлоад задерживает ответ на sleepSeconds, и у сервера
+	// должно остаться время ответить сверх этой задержки
+	scanTimeout = 4 * sleepSeconds * time.Second
+)
+
+// заголовки, которые проверяются всегда, даже если их не было в исходном запросе
+var scannedHeaders = []string{"User-Agent", "Referer", "X-Forwarded-For", "X-Forwarded-Host"}
+
+// заголовки, изменение которых ломает сам запрос, а не проверяет приложение
+var skippedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Cookie":            true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+	"Accept-Encoding":   true,
+	"Proxy-Connection":  true,
+}
+
+var (
+	sqlErrorPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)SQL syntax.*MySQL|Warning.*mysql_|valid MySQL result|MySqlClient\.`),
+		regexp.MustCompile(`(?i)PostgreSQL.*ERROR|Warning.*\Wpg_|valid PostgreSQL result|Npgsql\.|unterminated quoted string at or near`),
+		regexp.MustCompile(`(?i)Driver.* SQL[\-_ ]*Server|OLE DB.* SQL Server|Unclosed quotation mark after the character string|Microsoft SQL Native Client error`),
+		regexp.MustCompile(`(?i)\bORA-[0-9]{5}|Oracle error|quoted string not properly terminated`),
+		regexp.MustCompile(`(?i)SQLite/JDBCDriver|SQLite\.Exception|System\.Data\.SQLite\.SQLiteException|sqlite3\.OperationalError|SQLITE_ERROR|unrecognized token:`),
+		regexp.MustCompile(`(?i)SQLSTATE\[|syntax error at or near`),
+	}
+	traversalPayloads = []traversalPayload{
+		{value: "../../../../../../../../etc/passwd", marker: "root:x:0:0:"},
+		{value: "..%2f..%2f..%2f..%2f..%2f..%2f..%2f..%2fetc%2fpasswd", encoded: true, marker: "root:x:0:0:"},
+		{value: `..\..\..\..\..\..\..\..\windows\win.ini`, marker: "[fonts]"},
+	}
+	ssrfPayloads = map[string]string{
+		"http://example.com/":                                 "Example Domain",
+		"http://169.254.169.254/latest/meta-data/":            "instance-id",
+		"file:///etc/passwd":                                  "root:x:0:0:",
+		"http://metadata.google.internal/computeMetadata/v1/": "instance/",
+	}
+	// имена параметров, в которых обычно передаются ссылки
+	urlParamPattern = regexp.MustCompile(`(?i)(url|uri|link|redirect|return|next|dest|target|callback|continue|goto|host|domain|feed|image|src|path)`)
+)
+
+// traversalPayload - payload обхода каталога и строка, по которой в ответе видно, что файл прочитан
+type traversalPayload struct {
+	value string
+	// encoded - value уже закодирован для URL и формы: повторное кодирование превратило бы %2f в %252f
+	encoded bool
+	marker  string
+}
+
+type insertionPoint struct {
+	location string
+	name     string
+	value    string
+}
+
+func (p insertionPoint) String() string {
+	return fmt.Sprintf("%s:%s", p.location, p.name)
+}
+
+// probe - отправленный сканером запрос вместе с полученным ответом
+type probe struct {
+	req        *http.Request
+	res        *http.Response
+	reqBody    string
+	body       string
+	duration   time.Duration
+	timing     *entity.Timing
+	connection *entity.ConnectionInfo
+}
+
+type activeScan struct {
+	scanner  *Scanner
+	obj      *entity.HistoryObject
+	id       string
+	client   *http.Client
+	baseline *probe
+	stable   bool // совпадают ли два одинаковых запроса - без этого boolean-based проверки бессмысленны
+	findings map[string]entity.Finding
+}
+
+func (s *Scanner) ActiveScan(id string) ([]entity.Finding, error) {
+	finish := metrics.StartScan(string(entity.ScanKindActive))
+	findings, err := s.activeScan(id)
+	finish(err)
+	return findings, err
+}
+
+func (s *Scanner) activeScan(id string) ([]entity.Finding, error) {
+	obj, err := s.HistoryRepository.GetHistoryObject(id)
+	if err != nil {
+		return nil, err
+	}
+	err = s.scopeUsecase.CheckURL(obj.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &activeScan{
+		scanner:  s,
+		obj:      obj,
+		id:       id,
+		client:   scanClient(s.upstreamUsecase.HTTPClient()),
+		findings: make(map[string]entity.Finding),
+	}
+
+	a.baseline, err = a.send(nil, "")
+	if err != nil {
+		return nil, err
+	}
+	second, err := a.send(nil, "")
+	if err != nil {
+		return nil, err
+	}
+	a.stable = similar(a.baseline, second, "")
+
+	points := a.insertionPoints()
+	for i, point := range points {
+		slog.Debug("Активное сканирование точки вставки", "url", obj.Request.URL, "point", point.String())
+		s.liveUsecase.Publish(scanEvent(entity.ScanKindActive, id, i, len(points)))
+		checks := []func(insertionPoint) error{
+			a.checkXSS,
+			a.checkSQLError,
+			a.checkSQLBoolean,
+			a.checkSQLTime,
+			a.checkCommandInjection,
+		}
+		if point.location == locationQuery || point.location == locationBody {
+			checks = append(checks, a.checkPathTraversal, a.checkOpenRedirect, a.checkSSRF)
+		}
+		for _, check := range checks {
+			// отдельный пейлоад может сломать запрос или соединение - это не повод прерывать всё сканирование
+			if err := check(point); err != nil {
+				slog.Warn("Ошибка проверки точки вставки", "point", point.String(), "error", err)
+			}
+		}
+	}
+	s.liveUsecase.Publish(scanEvent(entity.ScanKindActive, id, len(points), len(points)))
+
+	findings := make([]entity.Finding, 0, len(a.findings))
+	for _, f := range a.findings {
+		findings = append(findings, f)
+	}
+	err = s.FindingRepository.AddFindings(findings)
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func (a *activeScan) insertionPoints() []insertionPoint {
+	points := make([]insertionPoint, 0)
+
+	if u, err := url.Parse(a.obj.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			points = append(points, insertionPoint{locationQuery, name, values[0]})
+		}
+	}
+	if isFormBody(a.obj.Request) {
+		for name, values := range a.obj.Request.PostForm {
+			points = append(points, insertionPoint{locationBody, name, values[0]})
+		}
+	}
+	for _, cookie := range a.obj.Request.Cookies {
+		points = append(points, insertionPoint{locationCookie, cookie.Name, cookie.Value})
+	}
+
+	headers := make(map[string]bool)
+	for _, name := range scannedHeaders {
+		headers[name] = true
+	}
+	for name := range a.obj.Request.Header {
+		if !skippedHeaders[name] {
+			headers[name] = true
+		}
+	}
+	for name := range headers {
+		points = append(points, insertionPoint{locationHeader, name, a.obj.Request.Header.Get(name)})
+	}
+	return points
+}
+
+func isFormBody(req entity.SerializableRequest) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+}
+
+// scanClient возвращает копию клиента инструментов, у которой ожидание заголовков ответа ограничивает не
+// ResponseHeaderTimeout, а scanTimeout каждого запроса: иначе time-based проверки зависели бы от настроек таймаутов
+func scanClient(client *http.Client) *http.Client {
+	scan := *client
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		transport = transport.Clone()
+		transport.ResponseHeaderTimeout = 0
+		scan.Transport = transport
+	}
+	return &scan
+}
+
+// send восстанавливает исходный запрос, подставляет payload в точку вставки и отправляет его.
+// Если точка не указана, отправляется исходный запрос без изменений
+func (a *activeScan) send(point *insertionPoint, payload string) (*probe, error) {
+	return a.sendPayload(point, payload, false)
+}
+
+// sendEncoded отправляет payload, уже закодированный для URL и формы, без повторного кодирования
+func (a *activeScan) sendEncoded(point *insertionPoint, payload string) (*probe, error) {
+	return a.sendPayload(point, payload, true)
+}
+
+func (a *activeScan) sendPayload(point *insertionPoint, payload string, encoded bool) (*probe, error) {
+	req, err := entity.DeserializeRequest(a.obj.Request)
+	if err != nil {
+		return nil, err
+	}
+	// заголовки десериализованного запроса ссылаются на сохранённый объект, поэтому копируем их
+	req.Header = a.obj.Request.Header.Clone()
+	reqBody := a.obj.Request.Body
+
+	if point != nil {
+		// строку запроса и форму собираем вручную: url.Values заново закодировал бы и payload, и остальные параметры
+		value := payload
+		if !encoded {
+			value = url.QueryEscape(payload)
+		}
+		switch point.location {
+		case locationQuery:
+			req.URL.RawQuery = setParam(req.URL.RawQuery, point.name, value)
+		case locationBody:
+			reqBody = setParam(reqBody, point.name, value)
+		case locationCookie:
+			// собираем заголовок вручную: http.Cookie вырезает из значения кавычки и точки с запятой
+			cookies := make([]string, 0, len(a.obj.Request.Cookies))
+			for _, cookie := range a.obj.Request.Cookies {
+				value := cookie.Value
+				if cookie.Name == point.name {
+					value = payload
+				}
+				cookies = append(cookies, fmt.Sprintf("%s=%s", cookie.Name, value))
+			}
+			req.Header.Set("Cookie", strings.Join(cookies, "; "))
+		case locationHeader:
+			req.Header.Set(point.name, payload)
+		}
+	}
+	req.Body = io.NopCloser(strings.NewReader(reqBody))
+	req.ContentLength = int64(len(reqBody))
+
+	ctx, cancel := context.WithTimeout(req.Context(), scanTimeout)
+	defer cancel()
+	recorder := newTimingRecorder()
+	req = req.WithContext(recorder.withTrace(ctx))
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	timing := recorder.timing(time.Now())
+
+	return &probe{
+		req:        req,
+		res:        res,
+		reqBody:    reqBody,
+		body:       string(buf),
+		duration:   timing.Total,
+		timing:     timing,
+		connection: connectionInfo(nil, recorder.upstreamAddr(), res.TLS),
+	}, nil
+}
+
+// setParam заменяет в строке параметров вида a=1&b=2 значение параметра name уже закодированным value, оставляя
+// остальные параметры как есть. Повторы name удаляются, а если параметра нет, он добавляется в конец
+func setParam(raw, name, value string) string {
+	pairs := make([]string, 0)
+	replaced := false
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, _, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil || key != name {
+			pairs = append(pairs, pair)
+			continue
+		}
+		if !replaced {
+			pairs = append(pairs, rawKey+"="+value)
+			replaced = true
+		}
+	}
+	if !replaced {
+		pairs = append(pairs, url.QueryEscape(name)+"="+value)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// report сохраняет запрос-доказательство в историю и добавляет находку, если такой же ещё нет
+func (a *activeScan) report(point insertionPoint, check, title string, severity entity.Severity, confidence entity.Confidence, evidence string, probes ...*probe) error {
+	u := a.baseline.req.URL
+	key := fmt.Sprintf("%s|%s|%s|%s", check, u.Host, u.Path, point)
+	if _, ok := a.findings[key]; ok {
+		return nil
+	}
+
+	ids := make([]string, 0, len(probes))
+	for _, p := range probes {
+		p.req.Body = io.NopCloser(strings.NewReader(p.reqBody))
+		p.res.Body = io.NopCloser(strings.NewReader(p.body))
+		meta := entity.HistoryMeta{Timing: p.timing, Connection: p.connection}
+		// через usecase истории доказательство попадает в ленту и проходит пассивные проверки, как обычный обмен
+		id, err := a.scanner.historyUsecase.AddHistory(p.req, p.res, meta)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	a.findings[key] = entity.Finding{
+		HistoryID:   a.id,
+		Check:       check,
+		Title:       title,
+		Severity:    severity,
+		Confidence:  confidence,
+		Host:        u.Host,
+		Path:        u.Path,
+		Parameter:   point.String(),
+		Evidence:    evidence,
+		EvidenceIDs: ids,
+		Status:      entity.FindingStatusOpen,
+		DateTime:    time.Now().Format(time.RFC3339),
+	}
+	return nil
+}
+
+func (a *activeScan) checkXSS(point insertionPoint) error {
+	marker := "mtm" + strings.ToLower(randomString(8))
+	payload := fmt.Sprintf(`<%s>"'`, marker)
+	p, err := a.send(&point, payload)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToLower(p.res.Header.Get("Content-Type")), "html") {
+		return nil
+	}
+	idx := strings.Index(p.body, "<"+marker+">")
+	if idx == -1 {
+		return nil
+	}
+	return a.report(point, "reflected-xss", "Отражённый XSS", entity.SeverityHigh, entity.ConfidenceFirm,
+		excerpt(p.body, idx, len(marker)+2), p)
+}
+
+func (a *activeScan) checkSQLError(point insertionPoint) error {
+	for _, payload := range []string{point.value + "'", point.value + `"`} {
+		p, err := a.send(&point, payload)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range sqlErrorPatterns {
+			loc := pattern.FindStringIndex(p.body)
+			if loc == nil || pattern.MatchString(a.baseline.body) {
+				continue
+			}
+			return a.report(point, "sqli-error", "SQL-инъекция (error-based)", entity.SeverityHigh, entity.ConfidenceFirm,
+				excerpt(p.body, loc[0], loc[1]-loc[0]), p)
+		}
+	}
+	return nil
+}
+
+func (a *activeScan) checkSQLBoolean(point insertionPoint) error {
+	if !a.stable {
+		return nil
+	}
+	pairs := [][2]string{
+		{"' AND '1'='1", "' AND '1'='2"},
+		{" AND 1=1", " AND 1=2"},
+		{"' AND '1'='1'-- ", "' AND '1'='2'-- "},
+	}
+	for _, pair := range pairs {
+		truePayload, falsePayload := point.value+pair[0], point.value+pair[1]
+		truthy, err := a.send(&point, truePayload)
+		if err != nil {
+			return err
+		}
+		if !similar(a.baseline, truthy, truePayload) {
+			continue
+		}
+		falsy, err := a.send(&point, falsePayload)
+		if err != nil {
+			return err
+		}
+		if similar(a.baseline, falsy, falsePayload) {
+			continue
+		}
+		// повторяем ложное условие, чтобы исключить случайное расхождение
+		confirm, err := a.send(&point, falsePayload)
+		if err != nil {
+			return err
+		}
+		if similar(a.baseline, confirm, falsePayload) {
+			continue
+		}
+		evidence := fmt.Sprintf("%s -> %d (%d байт)\n%s -> %d (%d байт)",
+			truePayload, truthy.res.StatusCode, len(truthy.body), falsePayload, falsy.res.StatusCode, len(falsy.body))
+		return a.report(point, "sqli-boolean", "SQL-инъекция (boolean-based)", entity.SeverityHigh, entity.ConfidenceTentative, evidence, truthy, falsy)
+	}
+	return nil
+}
+
+func (a *activeScan) checkSQLTime(point insertionPoint) error {
+	payloads := []string{
+		fmt.Sprintf("' AND SLEEP(%d)-- ", sleepSeconds),
+		fmt.Sprintf("'; WAITFOR DELAY '0:0:%d'-- ", sleepSeconds),
+		fmt.Sprintf("' || pg_sleep(%d)-- ", sleepSeconds),
+		fmt.Sprintf(" AND SLEEP(%d)", sleepSeconds),
+	}
+	for _, payload := range payloads {
+		found, p, err := a.delayed(point, point.value+payload)
+		if err != nil {
+			return err
+		}
+		if found {
+			return a.report(point, "sqli-time", "SQL-инъекция (time-based)", entity.SeverityHigh, entity.ConfidenceFirm,
+				fmt.Sprintf("%s -> ответ через %s (исходный запрос: %s)", payload, p.duration, a.baseline.duration), p)
+		}
+	}
+	return nil
+}
+
+// delayed отправляет time-based payload дважды и считает его сработавшим, только если задержка воспроизвелась
+func (a *activeScan) delayed(point insertionPoint, payload string) (bool, *probe, error) {
+	var p *probe
+	for i := 0; i < 2; i++ {
+		var err error
+		p, err = a.send(&point, payload)
+		if err != nil {
+			return false, nil, err
+		}
+		if p.duration-a.baseline.duration < sleepThreshold {
+			return false, nil, nil
+		}
+	}
+	return true, p, nil
+}
+
+func (a *activeScan) checkPathTraversal(point insertionPoint) error {
+	for _, payload := range traversalPayloads {
+		if strings.Contains(a.baseline.body, payload.marker) {
+			continue
+		}
+		send := a.send
+		if payload.encoded {
+			send = a.sendEncoded
+		}
+		p, err := send(&point, payload.value)
+		if err != nil {
+			return err
+		}
+		if idx := strings.Index(p.body, payload.marker); idx != -1 {
+			return a.report(point, "path-traversal", "Обход каталога (path traversal)", entity.SeverityHigh, entity.ConfidenceCertain,
+				excerpt(p.body, idx, len(payload.marker)), p)
+		}
+	}
+	return nil
+}
+
+func (a *activeScan) checkOpenRedirect(point insertionPoint) error {
+	host := fmt.Sprintf("mtm%s.example.org", strings.ToLower(randomString(8)))
+	for _, payload := range []string{"https://" + host + "/", "//" + host + "/"} {
+		p, err := a.send(&point, payload)
+		if err != nil {
+			return err
+		}
+		location, err := p.res.Location()
+		if err != nil || location.Host != host {
+			continue
+		}
+		return a.report(point, "open-redirect", "Открытое перенаправление", entity.SeverityMedium, entity.ConfidenceCertain,
+			fmt.Sprintf("Location: %s", p.res.Header.Get("Location")), p)
+	}
+	return nil
+}
+
+func (a *activeScan) checkSSRF(point insertionPoint) error {
+	if !urlParamPattern.MatchString(point.name) && !strings.Contains(point.value, "://") {
+		return nil
+	}
+	for payload, marker := range ssrfPayloads {
+		if strings.Contains(a.baseline.body, marker) {
+			continue
+		}
+		p, err := a.send(&point, payload)
+		if err != nil {
+			return err
+		}
+		if idx := strings.Index(p.body, marker); idx != -1 {
+			return a.report(point, "ssrf", "Подделка серверных запросов (SSRF)", entity.SeverityHigh, entity.ConfidenceTentative,
+				fmt.Sprintf("%s -> %s", payload, excerpt(p.body, idx, len(marker))), p)
+		}
+	}
+	return nil
+}
+
+func (a *activeScan) checkCommandInjection(point insertionPoint) error {
+	// результат арифметики отличается от самого пейлоада, поэтому простое отражение ввода не даст ложного срабатывания
+	x, y := 10000+rand.Intn(80000), 10000+rand.Intn(80000)
+	expected := fmt.Sprint(x + y)
+	expr := fmt.Sprintf("$((%d+%d))", x, y)
+	for _, tmpl := range []string{";echo %s;", "|echo %s", "&&echo %s", "`echo %s`", "$(echo %s)"} {
+		payload := point.value + fmt.Sprintf(tmpl, expr)
+		p, err := a.send(&point, payload)
+		if err != nil {
+			return err
+		}
+		if idx := strings.Index(p.body, expected); idx != -1 && !strings.Contains(a.baseline.body, expected) {
+			return a.report(point, "command-injection", "Внедрение команд ОС", entity.SeverityHigh, entity.ConfidenceFirm,
+				excerpt(p.body, idx, len(expected)), p)
+		}
+	}
+
+	for _, tmpl := range []string{";sleep %d;", "|sleep %d", "`sleep %d`", "$(sleep %d)"} {
+		payload := point.value + fmt.Sprintf(tmpl, sleepSeconds)
+		found, p, err := a.delayed(point, payload)
+		if err != nil {
+			return err
+		}
+		if found {
+			return a.report(point, "command-injection", "Внедрение команд ОС (time-based)", entity.SeverityHigh, entity.ConfidenceTentative,
+				fmt.Sprintf("%s -> ответ через %s (исходный запрос: %s)", payload, p.duration, a.baseline.duration), p)
+		}
+	}
+	return nil
+}
+
+// similar сравнивает ответы по коду и длине тела, не учитывая отражённый в теле payload
+func similar(a, b *probe, payload string) bool {
+	if a.res.StatusCode != b.res.StatusCode {
+		return false
+	}
+	bodyA, bodyB := a.body, b.body
+	if payload != "" {
+		bodyB = strings.ReplaceAll(bodyB, payload, "")
+		bodyB = strings.ReplaceAll(bodyB, url.QueryEscape(payload), "")
+	}
+	diff := len(bodyA) - len(bodyB)
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= float64(max(len(bodyA), len(bodyB)))*0.02
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestActiveScanSendsPayloadBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		body    string
+		point   insertionPoint
+		payload string
+		encoded bool
+		// строка запроса и тело, которые должен получить сервер
+		query    string
+		sentBody string
+	}{
+		{
+			name:    "закодированный payload в строке запроса",
+			url:     "/file?name=report.pdf&lang=ru",
+			point:   insertionPoint{locationQuery, "name", "report.pdf"},
+			payload: "..%2f..%2fetc%2fpasswd",
+			encoded: true,
+			query:   "name=..%2f..%2fetc%2fpasswd&lang=ru",
+		},
+		{
+			name:    "обычный payload в строке запроса кодируется",
+			url:     "/file?name=report.pdf&lang=ru",
+			point:   insertionPoint{locationQuery, "name", "report.pdf"},
+			payload: `<x>"' &`,
+			query:   "name=%3Cx%3E%22%27+%26&lang=ru",
+		},
+		{
+			name:    "остальные параметры не перекодируются",
+			url:     "/file?b=%7e&a=1&name=x&name=y",
+			point:   insertionPoint{locationQuery, "name", "x"},
+			payload: "../etc/passwd",
+			query:   "b=%7e&a=1&name=..%2Fetc%2Fpasswd",
+		},
+		{
+			name:     "закодированный payload в форме",
+			url:      "/upload",
+			body:     "z=1&file=a.txt",
+			point:    insertionPoint{locationBody, "file", "a.txt"},
+			payload:  "..%2fetc%2fpasswd",
+			encoded:  true,
+			sentBody: "z=1&file=..%2fetc%2fpasswd",
+		},
+		{
+			name:     "параметр, которого нет в форме",
+			url:      "/upload",
+			body:     "z=1",
+			point:    insertionPoint{locationBody, "file name", ""},
+			payload:  "a b",
+			sentBody: "z=1&file+name=a+b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				buf, _ := io.ReadAll(r.Body)
+				body = string(buf)
+			}))
+			defer server.Close()
+
+			method := http.MethodGet
+			header := http.Header{}
+			if tt.body != "" {
+				method = http.MethodPost
+				header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			a := &activeScan{
+				obj: &entity.HistoryObject{Request: entity.SerializableRequest{
+					Method: method,
+					URL:    server.URL + tt.url,
+					Header: header,
+					Body:   tt.body,
+				}},
+				client: scanClient(server.Client()),
+			}
+			send := a.send
+			if tt.encoded {
+				send = a.sendEncoded
+			}
+			_, err := send(&tt.point, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.body == "" && query != tt.query {
+				t.Errorf("отправлена строка запроса %q, ожидалась %q", query, tt.query)
+			}
+			if tt.body != "" && body != tt.sentBody {
+				t.Errorf("отправлено тело %q, ожидалось %q", body, tt.sentBody)
+			}
+		})
+	}
+}
+
+func TestScanClientIgnoresResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	tools := server.Client()
+	tools.Transport.(*http.Transport).ResponseHeaderTimeout = 10 * time.Millisecond
+	client := scanClient(tools)
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("ответ медленнее ResponseHeaderTimeout инструментов не получен: %s", err)
+	}
+	_ = res.Body.Close()
+	if tools.Transport.(*http.Transport).ResponseHeaderTimeout != 10*time.Millisecond {
+		t.Error("scanClient изменил клиент инструментов")
+	}
+}
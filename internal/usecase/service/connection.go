@@ -0,0 +1,54 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net"
+)
+
+// connectionInfo описывает соединения обмена. Любой из аргументов может быть nil, если соединения не было
+func connectionInfo(client, upstream net.Addr, state *tls.ConnectionState) *entity.ConnectionInfo {
+	info := &entity.ConnectionInfo{}
+	if client != nil {
+		info.ClientAddr = client.String()
+	}
+	if upstream != nil {
+		info.UpstreamAddr = upstream.String()
+	}
+	if state != nil {
+		info.TLS = tlsInfo(state)
+	}
+	return info
+}
+
+func tlsInfo(state *tls.ConnectionState) *entity.TLSInfo {
+	info := &entity.TLSInfo{
+		Version:      tls.VersionName(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		ALPN:         state.NegotiatedProtocol,
+		SNI:          state.ServerName,
+		Certificates: make([]entity.CertificateInfo, 0, len(state.PeerCertificates)),
+	}
+	for _, cert := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, certificateInfo(cert))
+	}
+	return info
+}
+
+func certificateInfo(cert *x509.Certificate) entity.CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return entity.CertificateInfo{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		DNSNames:     cert.DNSNames,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		SHA256:       hex.EncodeToString(fingerprint[:]),
+		PEM:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/repository"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ExportFormatJSON     = "json"
+	ExportFormatMarkdown = "markdown"
+)
+
+type Finding struct {
+	FindingRepository repository.Finding
+}
+
+func NewFindingUsecase(findingRepo repository.Finding) usecase.FindingUsecase {
+	return &Finding{
+		FindingRepository: findingRepo,
+	}
+}
+
+func (f *Finding) FindingDashboard() ([]entity.HostFindings, error) {
+	findings, err := f.FindingRepository.GetAllFindings()
+	if err != nil {
+		return nil, err
+	}
+	return groupFindings(findings), nil
+}
+
+func (f *Finding) SetFindingStatus(id string, status entity.FindingStatus) error {
+	if !status.Valid() {
+		return fmt.Errorf("неизвестный статус находки: %s", status)
+	}
+	return f.FindingRepository.UpdateFindingStatus(id, status)
+}
+
+func (f *Finding) ExportFindings(format string) ([]byte, string, error) {
+	findings, err := f.FindingRepository.GetAllFindings()
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case ExportFormatJSON:
+		data, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return nil, "", err
+		}
+		return data, "application/json; charset=utf-8", nil
+	case ExportFormatMarkdown, "md":
+		return markdownReport(groupFindings(findings)), "text/markdown; charset=utf-8", nil
+	default:
+		return nil, "", fmt.Errorf("неизвестный формат отчёта: %s", format)
+	}
+}
+
+// groupFindings раскладывает находки по хостам, а внутри хоста - по уровням критичности от высокого к низкому
+func groupFindings(findings []entity.Finding) []entity.HostFindings {
+	byHost := make(map[string]map[entity.Severity][]entity.Finding)
+	for _, finding := range findings {
+		if byHost[finding.Host] == nil {
+			byHost[finding.Host] = make(map[entity.Severity][]entity.Finding)
+		}
+		byHost[finding.Host][finding.Severity] = append(byHost[finding.Host][finding.Severity], finding)
+	}
+
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	groups := make([]entity.HostFindings, 0, len(hosts))
+	for _, host := range hosts {
+		group := entity.HostFindings{Host: host}
+		for _, severity := range entity.Severities {
+			if len(byHost[host][severity]) == 0 {
+				continue
+			}
+			group.Severities = append(group.Severities, entity.SeverityFindings{
+				Severity: severity,
+				Findings: byHost[host][severity],
+			})
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func markdownReport(groups []entity.HostFindings) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Отчёт о находках\n\nСформирован: %s\n", time.Now().Format(time.RFC3339))
+	for _, group := range groups {
+		fmt.Fprintf(&buf, "\n## %s\n", group.Host)
+		for _, severity := range group.Severities {
+			fmt.Fprintf(&buf, "\n### %s\n", severity.Severity)
+			for _, finding := range severity.Findings {
+				fmt.Fprintf(&buf, "\n#### %s\n\n", finding.Title)
+				fmt.Fprintf(&buf, "- Проверка: `%s`\n", finding.Check)
+				fmt.Fprintf(&buf, "- Достоверность: %s\n", finding.Confidence)
+				fmt.Fprintf(&buf, "- Статус: %s\n", finding.Status)
+				fmt.Fprintf(&buf, "- Путь: `%s`\n", finding.Path)
+				if finding.Parameter != "" {
+					fmt.Fprintf(&buf, "- Параметр: `%s`\n", finding.Parameter)
+				}
+				if len(finding.EvidenceIDs) > 0 {
+					fmt.Fprintf(&buf, "- Записи истории: %s\n", strings.Join(finding.EvidenceIDs, ", "))
+				}
+				if finding.Evidence != "" {
+					fmt.Fprintf(&buf, "\n```\n%s\n```\n", finding.Evidence)
+				}
+			}
+		}
+	}
+	return buf.Bytes()
+}
@@ -2,75 +2,186 @@ package service
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"fmt"
 	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/logging"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
 	"github.com/blackHATred/mitm_proxy/internal/repository"
 	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type History struct {
 	HistoryRepository repository.History
-	params            []string
+	scannerUsecase    usecase.ScannerUsecase
+	scopeUsecase      usecase.ScopeUsecase
+	upstreamUsecase   usecase.UpstreamUsecase
+	liveUsecase       usecase.LiveUsecase
+	// словарь параметров для param miner, заменяется целиком при перезагрузке
+	paramsMu sync.RWMutex
+	params   []string
 }
 
-func NewHistoryUsecase(historyRepo repository.History, filename string) (usecase.HistoryUsecase, error) {
+func NewHistoryUsecase(historyRepo repository.History, scannerUC usecase.ScannerUsecase, scopeUC usecase.ScopeUsecase, upstreamUC usecase.UpstreamUsecase, liveUC usecase.LiveUsecase, filename string) (usecase.HistoryUsecase, error) {
 	h := &History{
 		HistoryRepository: historyRepo,
-		params:            make([]string, 0),
+		scannerUsecase:    scannerUC,
+		scopeUsecase:      scopeUC,
+		upstreamUsecase:   upstreamUC,
+		liveUsecase:       liveUC,
 	}
+	err := h.LoadParams(filename)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
 
+func (h *History) LoadParams(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("ошибка чтения словаря параметров: %s", err)
 	}
 	defer file.Close()
 
+	params := make([]string, 0)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		h.params = append(h.params, scanner.Text())
+		params = append(params, scanner.Text())
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return fmt.Errorf("ошибка чтения словаря параметров: %s", err)
 	}
 
-	return h, nil
+	h.paramsMu.Lock()
+	defer h.paramsMu.Unlock()
+	h.params = params
+	return nil
 }
 
-func (h *History) RequestRepeat(id string) (string, error) {
+func (h *History) RequestRepeat(id string, raw bool) (string, error) {
 	obj, err := h.HistoryRepository.GetHistoryObject(id)
 	if err != nil {
 		return "", err
 	}
+	err = h.scopeUsecase.CheckURL(obj.Request.URL)
+	if err != nil {
+		return "", err
+	}
+	if raw {
+		return h.repeatRaw(obj)
+	}
 
 	req, err := entity.DeserializeRequest(obj.Request)
 	if err != nil {
 		return "", err
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// отключаем следование переадресации
-			return http.ErrUseLastResponse
-		},
-		Transport: &http.Transport{
-			// отключаем проверку сертификатов
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
+	client := h.upstreamUsecase.HTTPClient()
 
+	recorder := newTimingRecorder()
+	req = req.WithContext(recorder.withTrace(req.Context()))
 	res, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer res.Body.Close()
+	_, err = peekBody(&res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	newID, err := h.addHistory(req, res, entity.HistoryMeta{
+		Timing:     recorder.timing(time.Now()),
+		Connection: connectionInfo(nil, recorder.upstreamAddr(), res.TLS),
+	})
+	if err != nil {
+		return "", err
+	}
+	return newID.Hex(), nil
+}
+
+// repeatRaw отправляет сохранённые байты запроса в сокет сервера и сохраняет полученный ответ
+func (h *History) repeatRaw(obj *entity.HistoryObject) (string, error) {
+	if obj.Raw == nil || len(obj.Raw.Request) == 0 {
+		return "", usecase.ErrNoRawRequest
+	}
+	target, err := url.Parse(obj.Request.URL)
+	if err != nil {
+		return "", err
+	}
+	// записи, сохранённые до очистки заголовков прокси, могут их содержать
+	rawRequest := stripProxyHeaders(obj.Raw.Request)
+	// разобранный запрос нужен для истории и для чтения ответа (например, у HEAD нет тела)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(rawRequest)))
+	if err != nil {
+		return "", fmt.Errorf("ошибка разбора сохранённого запроса: %s", err)
+	}
+	req.URL = target
+
+	recorder := newTimingRecorder()
+	ctx := recorder.withTrace(context.Background())
+	var conn net.Conn
+	var state *tls.ConnectionState
+	var forward *entity.ForwardProxy
+	if target.Scheme == "https" {
+		tlsConn, err := h.upstreamUsecase.DialTLS(ctx, upstreamAddr(target.Host, "443"), target.Hostname(), false)
+		if err != nil {
+			return "", err
+		}
+		cs := tlsConn.ConnectionState()
+		conn, state = tlsConn, &cs
+	} else {
+		conn, forward, err = h.upstreamUsecase.DialHTTP(ctx, upstreamAddr(target.Host, "80"))
+		if err != nil {
+			return "", err
+		}
+	}
+	defer conn.Close()
+
+	sent := rawRequest
+	if forward != nil {
+		// вышестоящий HTTP-прокси получает запрос в абсолютной форме, а в историю попадает запрос без его учётных данных
+		sent = absoluteForm(rawRequest, target.Host, forward.Authorization)
+	}
+	wire := &wireConn{Conn: conn}
+	_, err = wire.Write(sent)
+	if err != nil {
+		return "", fmt.Errorf("ошибка отправки запроса: %s", err)
+	}
+	recorder.mark(&recorder.wroteRequest)
+	reader := bufio.NewReader(wire)
+	if _, err := reader.Peek(1); err == nil {
+		recorder.mark(&recorder.firstByte)
+	}
+	res, err := readResponse(reader, req)
+	if err != nil {
+		return "", fmt.Errorf("ошибка чтения ответа: %s", err)
+	}
+	defer res.Body.Close()
+	_, err = peekBody(&res.Body)
+	if err != nil {
+		return "", err
+	}
 
-	newID, err := h.HistoryRepository.AddHistory(req, res)
+	newID, err := h.addHistory(req, res, entity.HistoryMeta{
+		Timing:     recorder.timing(time.Now()),
+		Connection: connectionInfo(nil, conn.RemoteAddr(), state),
+		Raw:        &entity.RawExchange{Request: rawRequest, Response: wire.captured()},
+	})
 	if err != nil {
 		return "", err
 	}
@@ -86,13 +197,35 @@ func (h *History) RequestDetails(id string) (*entity.HistoryObject, error) {
 	return obj, nil
 }
 
+func (h *History) FindByExchangeID(exchangeID string) (string, error) {
+	id, err := h.HistoryRepository.FindByExchangeID(exchangeID)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", usecase.ErrExchangeNotFound
+	}
+	return id, nil
+}
+
 func (h *History) RequestScan(id string) (*entity.ParamMinerObject, error) {
+	finish := metrics.StartScan(string(entity.ScanKindParams))
+	obj, err := h.requestScan(id)
+	finish(err)
+	return obj, err
+}
+
+func (h *History) requestScan(id string) (*entity.ParamMinerObject, error) {
 	// Реализуем атаку param miner, параметры берем из params.txt со случайным значением.
 	// Если в ответе есть параметр, который указан в params.txt, то добавляем его в ParamMinerObject
 	obj, err := h.HistoryRepository.GetHistoryObject(id)
 	if err != nil {
 		return nil, err
 	}
+	err = h.scopeUsecase.CheckURL(obj.Request.URL)
+	if err != nil {
+		return nil, err
+	}
 
 	req, err := entity.DeserializeRequest(obj.Request)
 	if err != nil {
@@ -103,17 +236,15 @@ func (h *History) RequestScan(id string) (*entity.ParamMinerObject, error) {
 		Param: make(map[string]entity.SerializablePair),
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
+	client := h.upstreamUsecase.HTTPClient()
+	// сканирование доводится до конца с тем словарём, с которым началось
+	h.paramsMu.RLock()
+	params := h.params
+	h.paramsMu.RUnlock()
 
-	for _, param := range h.params {
-		log.Printf("url: %s param: %s", req.URL, param)
+	for i, param := range params {
+		slog.Debug("Подбор параметра", "url", req.URL.String(), "param", param)
+		h.liveUsecase.Publish(scanEvent(entity.ScanKindParams, id, i, len(params)))
 
 		clonedReq := req.Clone(req.Context())
 		q := clonedReq.URL.Query()
@@ -153,6 +284,7 @@ func (h *History) RequestScan(id string) (*entity.ParamMinerObject, error) {
 			Response: *serializedRes,
 		}
 	}
+	h.liveUsecase.Publish(scanEvent(entity.ScanKindParams, id, len(params), len(params)))
 
 	return paramMinerObject, nil
 }
@@ -175,9 +307,99 @@ func (h *History) RequestList() ([]entity.RequestListElem, error) {
 	return list, nil
 }
 
-func (h *History) AddHistory(req *http.Request, res *http.Response) error {
-	_, err := h.HistoryRepository.AddHistory(req, res)
-	return err
+func (h *History) AddHistory(req *http.Request, res *http.Response, meta entity.HistoryMeta) (string, error) {
+	id, err := h.addHistory(req, res, meta)
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (h *History) AddStream(req *http.Request, res *http.Response, meta entity.HistoryMeta) (string, error) {
+	// тело потока ещё не получено: сохраняются только заголовки ответа
+	body := res.Body
+	res.Body = http.NoBody
+	defer func() { res.Body = body }()
+
+	meta.Stream = &entity.Stream{Open: true, Events: []entity.StreamEvent{}}
+	meta.ConnID, meta.ExchangeID = logging.ConnID(req.Context()), logging.ExchangeID(req.Context())
+	id, err := h.HistoryRepository.AddHistory(req, res, meta)
+	if err != nil {
+		return "", err
+	}
+	slog.DebugContext(req.Context(), "Обмен сохранён в историю", "history_id", id.Hex())
+	h.liveUsecase.Publish(historyEvent(id, req, res, meta))
+	return id.Hex(), nil
+}
+
+func (h *History) AppendStreamEvents(id string, events []entity.StreamEvent) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	return h.HistoryRepository.AppendStreamEvents(objID, events)
+}
+
+func (h *History) CloseStream(id string, streamErr error) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	var message string
+	if streamErr != nil {
+		message = streamErr.Error()
+	}
+	err = h.HistoryRepository.CloseStream(objID, message)
+	if err != nil {
+		return err
+	}
+
+	// пассивные проверки запускаются, когда поток закончился: так в обмене уже есть все события
+	go func() {
+		if _, err := h.scannerUsecase.PassiveScan(id); err != nil {
+			slog.Error("Ошибка пассивного сканирования", "history_id", id, "error", err)
+		}
+	}()
+	return nil
+}
+
+func (h *History) StreamEvents(id string, from int) (*entity.Stream, error) {
+	obj, err := h.HistoryRepository.GetHistoryObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Stream == nil {
+		return nil, fmt.Errorf("ответ запроса %s не является потоком", id)
+	}
+	stream := *obj.Stream
+	events := stream.Events[min(max(from, 0), len(stream.Events)):]
+	stream.Events = append([]entity.StreamEvent{}, events...)
+	return &stream, nil
+}
+
+// addHistory сохраняет обмен и запускает по нему пассивное сканирование
+func (h *History) addHistory(req *http.Request, res *http.Response, meta entity.HistoryMeta) (primitive.ObjectID, error) {
+	// идентификаторы есть у обменов, прошедших через прокси, у повторов и сканирования их нет
+	meta.ConnID, meta.ExchangeID = logging.ConnID(req.Context()), logging.ExchangeID(req.Context())
+	id, err := h.HistoryRepository.AddHistory(req, res, meta)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	slog.DebugContext(req.Context(), "Обмен сохранён в историю", "history_id", id.Hex())
+	h.liveUsecase.Publish(historyEvent(id, req, res, meta))
+
+	if res == nil {
+		// без ответа пассивным проверкам анализировать нечего
+		return id, nil
+	}
+
+	// пассивные проверки не должны задерживать ответ клиенту, поэтому выполняем их в фоне
+	go func() {
+		if _, err := h.scannerUsecase.PassiveScan(id.Hex()); err != nil {
+			slog.Error("Ошибка пассивного сканирования", "history_id", id.Hex(), "error", err)
+		}
+	}()
+	return id, nil
 }
 
 func (h *History) GetCertificate(host string) (*tls.Certificate, error) {
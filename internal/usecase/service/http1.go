@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// maxInterimResponses ограничивает число промежуточных ответов перед окончательным, чтобы сервер не мог держать обмен бесконечно
+const maxInterimResponses = 16
+
+var errTooManyInterim = errors.New("сервер прислал слишком много промежуточных ответов")
+
+// readResponse читает ответ на req, пропуская промежуточные ответы 1xx: о них сообщается через трассировку запроса.
+// 101 Switching Protocols считается окончательным ответом
+func readResponse(reader *bufio.Reader, req *http.Request) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	for range maxInterimResponses {
+		res, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= http.StatusOK || res.StatusCode == http.StatusSwitchingProtocols {
+			return res, nil
+		}
+		if trace == nil {
+			continue
+		}
+		if res.StatusCode == http.StatusContinue && trace.Got100Continue != nil {
+			trace.Got100Continue()
+		}
+		if trace.Got1xxResponse != nil {
+			err = trace.Got1xxResponse(res.StatusCode, textproto.MIMEHeader(res.Header))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, errTooManyInterim
+}
+
+// withInterimRelay добавляет в контекст трассировку, которая пересылает клиенту промежуточные ответы сервера
+// (например, 103 Early Hints). 100 Continue не пересылается: на Expect клиента прокси отвечает сам
+func (p Proxy) withInterimRelay(ctx context.Context, conn net.Conn, req *http.Request) context.Context {
+	if !req.ProtoAtLeast(1, 1) {
+		// клиенты HTTP/1.0 промежуточных ответов не ожидают
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+			return writeInterim(conn, code, http.Header(header), p.timeouts)
+		},
+	})
+}
+
+func writeInterim(conn net.Conn, code int, header http.Header, timeouts entity.Timeouts) error {
+	_ = conn.SetWriteDeadline(entity.Deadline(timeouts.Write))
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if err != nil {
+		return err
+	}
+	err = header.Write(conn)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(conn, "\r\n")
+	return err
+}
+
+// expectContinue подменяет тело запроса с Expect: 100-continue так, чтобы клиент получил 100 Continue,
+// только когда прокси начнёт читать тело. Сам заголовок на сервер не уходит: тело к этому моменту уже будет у прокси
+func expectContinue(conn net.Conn, req *http.Request, timeouts entity.Timeouts) {
+	if !strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		return
+	}
+	req.Header.Del("Expect")
+	if !req.ProtoAtLeast(1, 1) || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	req.Body = &continueReader{ReadCloser: req.Body, conn: conn, timeouts: timeouts}
+}
+
+// continueReader отправляет клиенту 100 Continue перед первым чтением тела
+type continueReader struct {
+	io.ReadCloser
+	conn     net.Conn
+	timeouts entity.Timeouts
+	sent     bool
+}
+
+func (r *continueReader) Read(b []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		err := writeInterim(r.conn, http.StatusContinue, nil, r.timeouts)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка отправки 100 Continue: %w", err)
+		}
+	}
+	return r.ReadCloser.Read(b)
+}
+
+// keepAlive сообщает, можно ли читать из соединения следующий запрос после того, как клиент получил ответ res на req
+func keepAlive(req *http.Request, res *http.Response) bool {
+	if req.Close || res.Close || res.StatusCode == http.StatusSwitchingProtocols {
+		return false
+	}
+	if req.Method == http.MethodHead || !bodyAllowedForStatus(res.StatusCode) {
+		return true
+	}
+	// тело без длины и chunked-кодирования заканчивается только закрытием соединения
+	return res.ContentLength >= 0 || slices.Contains(res.TransferEncoding, "chunked")
+}
+
+func bodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code < 200:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordConn запоминает всё, что прокси пишет клиенту
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func (c *recordConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestReadRequestPipelined(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		bodies   []string
+		trailers []http.Header
+	}{
+		{
+			name: "два GET подряд",
+			requests: []string{
+				"GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n",
+				"GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			},
+			bodies: []string{"", ""},
+		},
+		{
+			name: "POST с Content-Length и следом GET",
+			requests: []string{
+				"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Length: 7\r\n\r\na=1&b=2",
+				"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			},
+			bodies: []string{"a=1&b=2", ""},
+		},
+		{
+			name: "chunked с трейлером и следом GET",
+			requests: []string{
+				"POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+					"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+				"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			},
+			bodies:   []string{"hello world", ""},
+			trailers: []http.Header{{"X-Checksum": {"abc"}}, nil},
+		},
+		{
+			name: "Expect: 100-continue не мешает следующему запросу",
+			requests: []string{
+				"PUT /file HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\ndata",
+				"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			},
+			bodies: []string{"data", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			// ответы прокси (например, 100 Continue) клиенту не нужны, но без чтения запись в pipe заблокируется
+			go func() { _, _ = io.Copy(io.Discard, client) }()
+			go func() { _, _ = io.WriteString(client, strings.Join(tt.requests, "")) }()
+
+			reader := newWireReader(server, nil)
+			for i, want := range tt.requests {
+				req, err := readRequest(context.Background(), server, reader, entity.Timeouts{})
+				if err != nil {
+					t.Fatalf("запрос %d: %s", i, err)
+				}
+				raw, err := wireRequest(req)
+				if err != nil {
+					t.Fatalf("запрос %d: %s", i, err)
+				}
+				if string(raw) != want {
+					t.Errorf("запрос %d: исходные байты %q, ожидалось %q", i, raw, want)
+				}
+				body, _ := io.ReadAll(req.Body)
+				if string(body) != tt.bodies[i] {
+					t.Errorf("запрос %d: тело %q, ожидалось %q", i, body, tt.bodies[i])
+				}
+				if tt.trailers != nil && tt.trailers[i] != nil {
+					for name, values := range tt.trailers[i] {
+						if got := req.Trailer.Values(name); !slices.Equal(got, values) {
+							t.Errorf("запрос %d: трейлер %s = %q, ожидалось %q", i, name, got, values)
+						}
+					}
+				}
+				if req.Header.Get("Expect") != "" {
+					t.Errorf("запрос %d: заголовок Expect должен удаляться", i)
+				}
+			}
+			// клиент закрывает соединение только после всех запросов, иначе прокси не смог бы отправить 100 Continue
+			_ = client.Close()
+			_, err := readRequest(context.Background(), server, reader, entity.Timeouts{})
+			if err != io.EOF {
+				t.Errorf("после последнего запроса ожидался io.EOF, получено %v", err)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      string
+		sendContinue bool
+	}{
+		{
+			name:         "HTTP/1.1 с телом",
+			request:      "POST / HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\ndata",
+			sendContinue: true,
+		},
+		{
+			name:         "значение Expect в другом регистре",
+			request:      "POST / HTTP/1.1\r\nHost: example.com\r\nExpect: 100-Continue\r\nContent-Length: 4\r\n\r\ndata",
+			sendContinue: true,
+		},
+		{
+			name:    "HTTP/1.0 не получает промежуточный ответ",
+			request: "POST / HTTP/1.0\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\ndata",
+		},
+		{
+			name:    "без тела",
+			request: "POST / HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name:    "без Expect",
+			request: "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\ndata",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &recordConn{}
+			expectContinue(conn, req, entity.Timeouts{})
+			if req.Header.Get("Expect") != "" {
+				t.Error("заголовок Expect не должен уходить на сервер")
+			}
+			if conn.written.Len() != 0 {
+				t.Fatalf("100 Continue отправлен до чтения тела: %q", conn.written.String())
+			}
+
+			_, err = io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.sendContinue {
+				want = "HTTP/1.1 100 Continue\r\n\r\n"
+			}
+			if conn.written.String() != want {
+				t.Errorf("клиент получил %q, ожидалось %q", conn.written.String(), want)
+			}
+		})
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		stream  string
+		status  int
+		body    string
+		trailer http.Header
+		interim []int
+		keep    bool
+		// статус ответа, который идёт в потоке следом и должен читаться тем же reader
+		next int
+		err  error
+	}{
+		{
+			name:    "100 Continue перед ответом",
+			stream:  "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status:  http.StatusOK,
+			body:    "ok",
+			interim: []int{http.StatusContinue},
+			keep:    true,
+		},
+		{
+			name:    "103 Early Hints перед ответом",
+			stream:  "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status:  http.StatusOK,
+			body:    "ok",
+			interim: []int{http.StatusEarlyHints},
+			keep:    true,
+		},
+		{
+			name:   "101 считается окончательным ответом",
+			stream: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+			status: http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "слишком много промежуточных ответов",
+			stream: strings.Repeat("HTTP/1.1 102 Processing\r\n\r\n", maxInterimResponses+1),
+			err:    errTooManyInterim,
+		},
+		{
+			name:    "chunked с трейлером",
+			stream:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: abc\r\n\r\nHTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "hello",
+			trailer: http.Header{"X-Sum": {"abc"}},
+			keep:    true,
+			next:    http.StatusAccepted,
+		},
+		{
+			name:   "HEAD без тела при Content-Length",
+			method: http.MethodHead,
+			stream: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nHTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n",
+			status: http.StatusOK,
+			keep:   true,
+			next:   http.StatusAccepted,
+		},
+		{
+			name:   "204 без тела",
+			stream: "HTTP/1.1 204 No Content\r\n\r\nHTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n",
+			status: http.StatusNoContent,
+			keep:   true,
+			next:   http.StatusAccepted,
+		},
+		{
+			name:   "304 без тела",
+			stream: "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\nHTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n",
+			status: http.StatusNotModified,
+			keep:   true,
+			next:   http.StatusAccepted,
+		},
+		{
+			name:   "Connection: close",
+			stream: "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok",
+			status: http.StatusOK,
+			body:   "ok",
+		},
+		{
+			name:   "тело до закрытия соединения",
+			stream: "HTTP/1.1 200 OK\r\n\r\nuntil close",
+			status: http.StatusOK,
+			body:   "until close",
+		},
+		{
+			name:   "HTTP/1.0 без keep-alive",
+			stream: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status: http.StatusOK,
+			body:   "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			var interim []int
+			ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					interim = append(interim, code)
+					return nil
+				},
+			})
+			req, _ := http.NewRequestWithContext(ctx, method, "http://example.com/", nil)
+			reader := bufio.NewReader(strings.NewReader(tt.stream))
+
+			res, err := readResponse(reader, req)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ожидалась ошибка %v, получено %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Errorf("статус %d, ожидался %d", res.StatusCode, tt.status)
+			}
+			if !slices.Equal(interim, tt.interim) {
+				t.Errorf("промежуточные ответы %v, ожидались %v", interim, tt.interim)
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("тело %q, ожидалось %q", body, tt.body)
+			}
+			for name, values := range tt.trailer {
+				if got := res.Trailer.Values(name); !slices.Equal(got, values) {
+					t.Errorf("трейлер %s = %q, ожидалось %q", name, got, values)
+				}
+			}
+			if got := keepAlive(req, res); got != tt.keep {
+				t.Errorf("keepAlive = %t, ожидалось %t", got, tt.keep)
+			}
+
+			if tt.next != 0 {
+				next, err := readResponse(reader, req)
+				if err != nil {
+					t.Fatalf("следующий ответ: %s", err)
+				}
+				if next.StatusCode != tt.next {
+					t.Errorf("следующий ответ: статус %d, ожидался %d", next.StatusCode, tt.next)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepAliveClientClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		keep    bool
+	}{
+		{"HTTP/1.1 по умолчанию", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"Connection: close", "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", false},
+		{"HTTP/1.0 без keep-alive", "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n", false},
+		{"HTTP/1.0 с keep-alive", "GET / HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &http.Response{StatusCode: http.StatusOK, ContentLength: 0}
+			if got := keepAlive(req, res); got != tt.keep {
+				t.Errorf("keepAlive = %t, ожидалось %t", got, tt.keep)
+			}
+		})
+	}
+}
+
+func TestInterimRelay(t *testing.T) {
+	stream := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	tests := []struct {
+		name  string
+		proto string
+		want  string
+	}{
+		{
+			name:  "HTTP/1.1 получает 103, но не 100",
+			proto: "HTTP/1.1",
+			want:  "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n",
+		},
+		{
+			name:  "HTTP/1.0 не получает промежуточных ответов",
+			proto: "HTTP/1.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET / " + tt.proto + "\r\nHost: example.com\r\n\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &recordConn{}
+			ctx := Proxy{}.withInterimRelay(context.Background(), conn, client)
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+
+			res, err := readResponse(bufio.NewReader(strings.NewReader(stream)), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("статус %d, ожидался 200", res.StatusCode)
+			}
+			if conn.written.String() != tt.want {
+				t.Errorf("клиент получил %q, ожидалось %q", conn.written.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type pendingMessage struct {
+	msg      entity.InterceptedMessage
+	decision chan entity.InterceptDecision
+}
+
+type Intercept struct {
+	mu      sync.Mutex
+	filter  entity.InterceptFilter
+	path    *regexp.Regexp
+	timeout time.Duration
+	pending map[string]*pendingMessage
+}
+
+func NewInterceptUsecase(timeout time.Duration) usecase.InterceptUsecase {
+	return &Intercept{
+		timeout: timeout,
+		pending: make(map[string]*pendingMessage),
+	}
+}
+
+func (i *Intercept) Filter() entity.InterceptFilter {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.filter
+}
+
+func (i *Intercept) SetFilter(filter entity.InterceptFilter) error {
+	var path *regexp.Regexp
+	if filter.Path != "" {
+		var err error
+		path, err = regexp.Compile(filter.Path)
+		if err != nil {
+			return fmt.Errorf("некорректное выражение для пути: %s", err)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.filter = filter
+	i.path = path
+	if !filter.Enabled {
+		// при выключении перехвата отпускаем всё, что уже ждёт в очереди
+		for id, p := range i.pending {
+			p.decision <- entity.InterceptDecision{Action: entity.InterceptActionForward}
+			delete(i.pending, id)
+		}
+	}
+	return nil
+}
+
+func (i *Intercept) matches(req *http.Request, direction entity.RuleDirection) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.filter.Enabled || (direction == entity.RuleDirectionResponse && !i.filter.Responses) {
+		return false
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if !entity.MatchHostPattern(i.filter.Host, host) {
+		return false
+	}
+	if i.filter.Method != "" && !strings.EqualFold(i.filter.Method, req.Method) {
+		return false
+	}
+	return i.path == nil || i.path.MatchString(req.URL.Path)
+}
+
+func (i *Intercept) InterceptRequest(req *http.Request) (*http.Request, *http.Response, error) {
+	if !i.matches(req, entity.RuleDirectionRequest) {
+		return req, nil, nil
+	}
+
+	raw, err := rawRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	decision, err := i.wait(req, entity.RuleDirectionRequest, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch decision.Action {
+	case entity.InterceptActionDrop:
+		return nil, nil, usecase.ErrInterceptDropped
+	case entity.InterceptActionRespond:
+		res, err := parseRawResponse(decision.Raw, req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("некорректный ответ: %s", err)
+		}
+		return req, res, nil
+	}
+	if decision.Raw == "" || decision.Raw == raw {
+		return req, nil, nil
+	}
+	edited, err := parseRawRequest(decision.Raw, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("некорректный запрос: %s", err)
+	}
+	return edited, nil, nil
+}
+
+func (i *Intercept) InterceptResponse(req *http.Request, res *http.Response) (*http.Response, error) {
+	if !i.matches(req, entity.RuleDirectionResponse) {
+		return res, nil
+	}
+
+	raw, err := rawResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	decision, err := i.wait(req, entity.RuleDirectionResponse, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch decision.Action {
+	case entity.InterceptActionDrop:
+		return nil, usecase.ErrInterceptDropped
+	case entity.InterceptActionForward:
+		if decision.Raw == "" || decision.Raw == raw {
+			return res, nil
+		}
+	}
+	edited, err := parseRawResponse(decision.Raw, req)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный ответ: %s", err)
+	}
+	return edited, nil
+}
+
+// wait ставит сообщение в очередь и ждёт решения пользователя. Если решения нет дольше timeout,
+// сообщение отправляется без изменений, чтобы забытая точка останова не подвесила клиента.
+// Если контекст запроса завершился раньше (клиент отключился или прокси остановлен), сообщение убирается из очереди
+func (i *Intercept) wait(req *http.Request, direction entity.RuleDirection, raw string) (entity.InterceptDecision, error) {
+	p := &pendingMessage{
+		msg: entity.InterceptedMessage{
+			ID:        strings.ToLower(randomString(12)),
+			Direction: direction,
+			Method:    req.Method,
+			URL:       requestURL(req),
+			Raw:       raw,
+			Deadline:  time.Now().Add(i.timeout),
+		},
+		// буфер нужен, чтобы Resolve не блокировался, если ожидание уже завершилось по таймауту
+		decision: make(chan entity.InterceptDecision, 1),
+	}
+
+	i.mu.Lock()
+	i.pending[p.msg.ID] = p
+	i.mu.Unlock()
+
+	timer := time.NewTimer(i.timeout)
+	defer timer.Stop()
+	select {
+	case decision := <-p.decision:
+		return decision, nil
+	case <-timer.C:
+		i.mu.Lock()
+		delete(i.pending, p.msg.ID)
+		i.mu.Unlock()
+		slog.WarnContext(req.Context(), "Истекло время ожидания решения, сообщение отправлено без изменений", "method", p.msg.Method, "url", p.msg.URL)
+		return entity.InterceptDecision{Action: entity.InterceptActionForward}, nil
+	case <-req.Context().Done():
+		i.mu.Lock()
+		delete(i.pending, p.msg.ID)
+		i.mu.Unlock()
+		return entity.InterceptDecision{}, fmt.Errorf("ожидание решения прервано: %w", req.Context().Err())
+	}
+}
+
+func (i *Intercept) Pending() []entity.InterceptedMessage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	messages := make([]entity.InterceptedMessage, 0, len(i.pending))
+	for _, p := range i.pending {
+		messages = append(messages, p.msg)
+	}
+	sort.Slice(messages, func(a, b int) bool {
+		return messages[a].Deadline.Before(messages[b].Deadline)
+	})
+	return messages
+}
+
+func (i *Intercept) Resolve(id string, decision entity.InterceptDecision) error {
+	switch decision.Action {
+	case entity.InterceptActionForward, entity.InterceptActionDrop, entity.InterceptActionRespond:
+	default:
+		return fmt.Errorf("неизвестное действие: %s", decision.Action)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	p, ok := i.pending[id]
+	if !ok {
+		return errors.New("сообщение не найдено или уже отправлено")
+	}
+	delete(i.pending, id)
+	p.decision <- decision
+	return nil
+}
+
+func requestURL(req *http.Request) string {
+	if req.URL.Host != "" {
+		return req.URL.String()
+	}
+	return fmt.Sprintf("https://%s%s", req.Host, req.URL.String())
+}
+
+// rawRequest представляет запрос в текстовом виде. Тело выводится целиком, без chunked-кодирования
+func rawRequest(req *http.Request) (string, error) {
+	body, err := peekBody(&req.Body)
+	if err != nil {
+		return "", err
+	}
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/%d.%d\r\n", req.Method, uri, req.ProtoMajor, req.ProtoMinor)
+	fmt.Fprintf(&buf, "Host: %s\r\n", req.Host)
+	header := req.Header.Clone()
+	header.Del("Transfer-Encoding")
+	if len(body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	err = header.Write(&buf)
+	if err != nil {
+		return "", err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.String(), nil
+}
+
+func rawResponse(res *http.Response) (string, error) {
+	body, err := peekBody(&res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.Status)
+	header := res.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	err = header.Write(&buf)
+	if err != nil {
+		return "", err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.String(), nil
+}
+
+// peekBody вычитывает тело целиком и подменяет его копией, чтобы его можно было прочитать повторно
+func peekBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	buf, err := io.ReadAll(*body)
+	if err != nil {
+		return nil, err
+	}
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewBuffer(buf))
+	return buf, nil
+}
+
+var blankLine = regexp.MustCompile(`\r?\n\r?\n`)
+
+// splitRaw отделяет заголовки от тела и приводит переводы строк в заголовках к CRLF:
+// textarea в браузере может прислать как \r\n, так и \n
+func splitRaw(raw string) (string, string) {
+	head, body := raw, ""
+	if loc := blankLine.FindStringIndex(raw); loc != nil {
+		head, body = raw[:loc[0]], raw[loc[1]:]
+	}
+	head = strings.ReplaceAll(strings.ReplaceAll(head, "\r\n", "\n"), "\n", "\r\n")
+	return head + "\r\n\r\n", body
+}
+
+func parseRawRequest(raw string, orig *http.Request) (*http.Request, error) {
+	head, body := splitRaw(raw)
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head)))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Host == "" && orig.URL.Host != "" {
+		// запрос к обычному HTTP-прокси должен остаться в абсолютной форме
+		req.URL.Scheme = orig.URL.Scheme
+		req.URL.Host = req.Host
+	}
+	setBody(req.Header, &req.Body, &req.ContentLength, body)
+	req.TransferEncoding = nil
+	return req.WithContext(orig.Context()), nil
+}
+
+func parseRawResponse(raw string, req *http.Request) (*http.Response, error) {
+	head, body := splitRaw(raw)
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(head)), req)
+	if err != nil {
+		return nil, err
+	}
+	setBody(res.Header, &res.Body, &res.ContentLength, body)
+	res.TransferEncoding = nil
+	// без Content-Length в заголовках ReadResponse считает, что тело читается до закрытия соединения
+	res.Close = false
+	return res, nil
+}
+
+// setBody заменяет тело сообщения и пересчитывает длину: после ручного редактирования Content-Length почти наверняка устарел
+func setBody(header http.Header, dst *io.ReadCloser, length *int64, body string) {
+	header.Del("Transfer-Encoding")
+	if body == "" && header.Get("Content-Length") == "" {
+		*dst = http.NoBody
+		*length = 0
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	*dst = io.NopCloser(strings.NewReader(body))
+	*length = int64(len(body))
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// liveBuffer - сколько событий может накопиться у подписчика, прежде чем новые начнут пропускаться
+const liveBuffer = 256
+
+type Live struct {
+	mu          sync.Mutex
+	subscribers map[*liveSubscriber]struct{}
+}
+
+type liveSubscriber struct {
+	filter entity.LiveFilter
+	events chan entity.LiveEvent
+}
+
+func NewLiveUsecase() usecase.LiveUsecase {
+	return &Live{subscribers: make(map[*liveSubscriber]struct{})}
+}
+
+func (l *Live) Publish(event entity.LiveEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s := range l.subscribers {
+		// фильтр относится к обменам, ход сканирования получают все
+		if event.Request != nil && !s.filter.Match(*event.Request) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+}
+
+func (l *Live) Subscribe(filter entity.LiveFilter) (<-chan entity.LiveEvent, func()) {
+	s := &liveSubscriber{filter: filter, events: make(chan entity.LiveEvent, liveBuffer)}
+	l.mu.Lock()
+	l.subscribers[s] = struct{}{}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.subscribers, s)
+			close(s.events)
+		})
+	}
+}
+
+// historyEvent описывает для живой ленты обмен, сохранённый в историю под id
+func historyEvent(id primitive.ObjectID, req *http.Request, res *http.Response, meta entity.HistoryMeta) entity.LiveEvent {
+	elem := entity.RequestListElem{
+		ID:       id.Hex(),
+		DateTime: time.Now().Format(time.RFC3339),
+		Method:   req.Method,
+		URL:      entity.RequestURL(req),
+		User:     meta.User,
+		Error:    meta.Error,
+	}
+	if res != nil {
+		elem.Status = res.StatusCode
+	}
+	return entity.LiveEvent{Type: entity.LiveEventHistory, Request: &elem}
+}
+
+// scanEvent описывает для живой ленты ход сканирования запроса id
+func scanEvent(kind entity.ScanKind, id string, done, total int) entity.LiveEvent {
+	return entity.LiveEvent{
+		Type: entity.LiveEventScan,
+		Scan: &entity.ScanProgress{Kind: kind, HistoryID: id, Done: done, Total: total},
+	}
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst - SO_ORIGINAL_DST из linux/netfilter_ipv4.h (у IP6T_SO_ORIGINAL_DST то же значение)
+const soOriginalDst = 80
+
+// originalDst возвращает адрес, к которому клиент подключался до перенаправления правилом iptables REDIRECT/DNAT
+func originalDst(conn net.Conn) (string, error) {
+	// слушатель может обернуть соединение, поэтому добираемся до исходного TCP-соединения
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("исходный адрес назначения доступен только для TCP-соединений")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var addr string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		addr, sockErr = originalDstFd(int(fd))
+	})
+	if err != nil {
+		return "", err
+	}
+	return addr, sockErr
+}
+
+// originalDstFd выбирает запрос по семейству сокета, а не по локальному адресу: двухстековый сокет AF_INET6
+// принимает и IPv4-клиентов с адресами вида ::ffff:a.b.c.d. Для них у ядра нет записи IPv6 (ENOENT),
+// и адрес запрашивается как для IPv4
+func originalDstFd(fd int) (string, error) {
+	domain, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	if err != nil {
+		return "", err
+	}
+	if domain == syscall.AF_INET {
+		return originalDstIPv4(fd)
+	}
+	addr, err := originalDstIPv6(fd)
+	if errors.Is(err, syscall.ENOENT) {
+		return originalDstIPv4(fd)
+	}
+	return addr, err
+}
+
+func originalDstIPv4(fd int) (string, error) {
+	// ядро возвращает struct sockaddr_in, которая помещается в IPv6Mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	sa := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(sa[2:4])
+	return net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(port))), nil
+}
+
+func originalDstIPv6(fd int) (string, error) {
+	// ядро возвращает struct sockaddr_in6, которая помещается в IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	// порт хранится в сетевом порядке байт
+	var port [2]byte
+	binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+	return net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
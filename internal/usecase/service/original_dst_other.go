@@ -0,0 +1,12 @@
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("прозрачный режим поддерживается только в Linux")
+}
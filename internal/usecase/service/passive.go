@@ -0,0 +1,264 @@
+package service
+
+import (
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// passiveCheck анализирует сохранённый обмен и возвращает найденные проблемы без отправки новых запросов
+type passiveCheck func(obj *entity.HistoryObject) []entity.Finding
+
+func defaultPassiveChecks() []passiveCheck {
+	return []passiveCheck{
+		checkSecurityHeaders,
+		checkCookieFlags,
+		checkReflectedInput,
+		checkStackTraces,
+		checkSecrets,
+		checkMixedContent,
+		checkCORS,
+	}
+}
+
+// минимальная длина значения параметра, при которой его отражение в ответе считается значимым
+const minReflectedValueLength = 4
+
+var (
+	stackTracePatterns = map[string]*regexp.Regexp{
+		"Java":    regexp.MustCompile(`(?m)^\s*at [\w$.]+\([\w$]+\.java:\d+\)`),
+		"Python":  regexp.MustCompile(`Traceback \(most recent call last\):`),
+		"PHP":     regexp.MustCompile(`(?i)(Fatal error|Warning|Parse error)</b>?:.+ on line <b>?\d+`),
+		".NET":    regexp.MustCompile(`(?i)(Server Error in '.*' Application|at [\w.]+\(.*\) in .+:line \d+)`),
+		"Go":      regexp.MustCompile(`goroutine \d+ \[running\]:`),
+		"Node.js": regexp.MustCompile(`(?m)^\s*at .+ \((/|[A-Za-z]:\\).+\.js:\d+:\d+\)`),
+		"Ruby":    regexp.MustCompile(`(?m)^.+\.rb:\d+:in ` + "`"),
+	}
+	secretPatterns = map[string]*regexp.Regexp{
+		"AWS Access Key ID":  regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+		"Google API Key":     regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`),
+		"GitHub Token":       regexp.MustCompile(`\bgh[pousr]_[0-9A-Za-z]{36}\b`),
+		"Slack Token":        regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z\-]{10,}\b`),
+		"Stripe Secret Key":  regexp.MustCompile(`\b[sr]k_live_[0-9A-Za-z]{24,}\b`),
+		"Private Key":        regexp.MustCompile(`-----BEGIN (RSA |EC |DSA |OPENSSH )?PRIVATE KEY-----`),
+		"JSON Web Token":     regexp.MustCompile(`\beyJ[0-9A-Za-z_\-]+\.eyJ[0-9A-Za-z_\-]+\.[0-9A-Za-z_\-]+\b`),
+		"Generic API Secret": regexp.MustCompile(`(?i)["']?(api[_-]?key|api[_-]?secret|access[_-]?token|client[_-]?secret)["']?\s*[:=]\s*["'][0-9A-Za-z_\-]{16,}["']`),
+	}
+	mixedContentPattern = regexp.MustCompile(`(?i)<(script|iframe|img|link|embed|object|audio|video|source|form)\b[^>]*\b(src|href|action)\s*=\s*["']?(http://[^"'\s>]+)`)
+)
+
+// sortedKeys возвращает ключи m по порядку: от порядка обхода зависит порядок находок в отчёте
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isHTML(res entity.SerializableResponse) bool {
+	return strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "text/html")
+}
+
+func isHTTPS(req entity.SerializableRequest) bool {
+	return strings.HasPrefix(req.URL, "https://")
+}
+
+func checkSecurityHeaders(obj *entity.HistoryObject) []entity.Finding {
+	res := obj.Response
+	if !isHTML(res) {
+		// заголовки защиты браузера имеют смысл только для документов
+		return nil
+	}
+
+	findings := make([]entity.Finding, 0)
+	missing := func(header string, severity entity.Severity) {
+		findings = append(findings, entity.Finding{
+			Check:      "missing-security-header",
+			Title:      fmt.Sprintf("Отсутствует заголовок %s", header),
+			Severity:   severity,
+			Confidence: entity.ConfidenceCertain,
+			Evidence:   fmt.Sprintf("В ответе %s нет заголовка %s", res.Status, header),
+		})
+	}
+
+	csp := res.Header.Get("Content-Security-Policy")
+	if csp == "" {
+		missing("Content-Security-Policy", entity.SeverityLow)
+	}
+	if res.Header.Get("X-Frame-Options") == "" && !strings.Contains(csp, "frame-ancestors") {
+		missing("X-Frame-Options", entity.SeverityLow)
+	}
+	if !strings.EqualFold(res.Header.Get("X-Content-Type-Options"), "nosniff") {
+		missing("X-Content-Type-Options", entity.SeverityInfo)
+	}
+	if isHTTPS(obj.Request) && res.Header.Get("Strict-Transport-Security") == "" {
+		missing("Strict-Transport-Security", entity.SeverityLow)
+	}
+	return findings
+}
+
+func checkCookieFlags(obj *entity.HistoryObject) []entity.Finding {
+	findings := make([]entity.Finding, 0)
+	for _, cookie := range obj.Response.Cookies {
+		if cookie == nil {
+			continue
+		}
+		problems := make([]string, 0, 3)
+		if !cookie.Secure && isHTTPS(obj.Request) {
+			problems = append(problems, "Secure")
+		}
+		if !cookie.HttpOnly {
+			problems = append(problems, "HttpOnly")
+		}
+		if cookie.SameSite == http.SameSiteDefaultMode {
+			problems = append(problems, "SameSite")
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		findings = append(findings, entity.Finding{
+			Check:      "cookie-flags",
+			Title:      fmt.Sprintf("Cookie без флагов %s", strings.Join(problems, ", ")),
+			Severity:   entity.SeverityLow,
+			Confidence: entity.ConfidenceCertain,
+			Parameter:  cookie.Name,
+			Evidence:   cookie.Raw,
+		})
+	}
+	return findings
+}
+
+func checkReflectedInput(obj *entity.HistoryObject) []entity.Finding {
+	if !isHTML(obj.Response) {
+		return nil
+	}
+
+	findings := make([]entity.Finding, 0)
+	for _, param := range sortedKeys(obj.Request.Form) {
+		values := obj.Request.Form[param]
+		for _, value := range values {
+			if len(value) < minReflectedValueLength {
+				continue
+			}
+			idx := strings.Index(obj.Response.Body, value)
+			if idx == -1 {
+				continue
+			}
+			findings = append(findings, entity.Finding{
+				Check:      "reflected-input",
+				Title:      "Отражение пользовательского ввода в ответе",
+				Severity:   entity.SeverityInfo,
+				Confidence: entity.ConfidenceTentative,
+				Parameter:  param,
+				Evidence:   excerpt(obj.Response.Body, idx, len(value)),
+			})
+			break
+		}
+	}
+	return findings
+}
+
+func checkStackTraces(obj *entity.HistoryObject) []entity.Finding {
+	findings := make([]entity.Finding, 0)
+	for _, platform := range sortedKeys(stackTracePatterns) {
+		pattern := stackTracePatterns[platform]
+		loc := pattern.FindStringIndex(obj.Response.Body)
+		if loc == nil {
+			continue
+		}
+		findings = append(findings, entity.Finding{
+			Check:      "stack-trace",
+			Title:      fmt.Sprintf("Утечка трассировки стека (%s)", platform),
+			Severity:   entity.SeverityMedium,
+			Confidence: entity.ConfidenceFirm,
+			Evidence:   excerpt(obj.Response.Body, loc[0], loc[1]-loc[0]),
+		})
+	}
+	return findings
+}
+
+func checkSecrets(obj *entity.HistoryObject) []entity.Finding {
+	findings := make([]entity.Finding, 0)
+	for _, kind := range sortedKeys(secretPatterns) {
+		pattern := secretPatterns[kind]
+		loc := pattern.FindStringIndex(obj.Response.Body)
+		if loc == nil {
+			continue
+		}
+		findings = append(findings, entity.Finding{
+			Check:      "exposed-secret",
+			Title:      fmt.Sprintf("Раскрытие секрета: %s", kind),
+			Severity:   entity.SeverityHigh,
+			Confidence: entity.ConfidenceTentative,
+			Evidence:   excerpt(obj.Response.Body, loc[0], loc[1]-loc[0]),
+		})
+	}
+	return findings
+}
+
+func checkMixedContent(obj *entity.HistoryObject) []entity.Finding {
+	if !isHTTPS(obj.Request) || !isHTML(obj.Response) {
+		return nil
+	}
+
+	matches := mixedContentPattern.FindAllStringSubmatch(obj.Response.Body, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	resources := make([]string, 0, len(matches))
+	for _, m := range matches {
+		resources = append(resources, m[3])
+	}
+	return []entity.Finding{{
+		Check:      "mixed-content",
+		Title:      "Смешанное содержимое на HTTPS-странице",
+		Severity:   entity.SeverityLow,
+		Confidence: entity.ConfidenceCertain,
+		Evidence:   strings.Join(resources, "\n"),
+	}}
+}
+
+func checkCORS(obj *entity.HistoryObject) []entity.Finding {
+	allowOrigin := obj.Response.Header.Get("Access-Control-Allow-Origin")
+	if allowOrigin == "" {
+		return nil
+	}
+	credentials := strings.EqualFold(obj.Response.Header.Get("Access-Control-Allow-Credentials"), "true")
+	origin := obj.Request.Header.Get("Origin")
+
+	var title string
+	confidence := entity.ConfidenceFirm
+	switch {
+	case allowOrigin == "null":
+		title = "CORS разрешает origin null"
+	case origin != "" && allowOrigin == origin && credentials:
+		// по одному ответу не отличить отражение любого Origin от белого списка, в который входит origin клиента
+		title = "CORS может отражать произвольный Origin вместе с учётными данными"
+		confidence = entity.ConfidenceTentative
+	case allowOrigin == "*" && credentials:
+		title = "CORS разрешает любой origin вместе с учётными данными"
+	default:
+		return nil
+	}
+
+	return []entity.Finding{{
+		Check:      "cors-misconfiguration",
+		Title:      title,
+		Severity:   entity.SeverityMedium,
+		Confidence: confidence,
+		Evidence:   fmt.Sprintf("Origin: %s\nAccess-Control-Allow-Origin: %s\nAccess-Control-Allow-Credentials: %t", origin, allowOrigin, credentials),
+	}}
+}
+
+// excerpt возвращает найденный фрагмент вместе с небольшим контекстом вокруг него
+func excerpt(s string, start, length int) string {
+	const around = 40
+	from := max(start-around, 0)
+	to := min(start+length+around, len(s))
+	return s[from:to]
+}
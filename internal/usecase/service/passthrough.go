@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+type Passthrough struct {
+	mu        sync.Mutex
+	patterns  []string
+	threshold int            // после стольких отказов клиента от сертификата хост добавляется в passthrough, 0 - никогда
+	failures  map[string]int // число отказов по хостам подряд, успешное рукопожатие обнуляет счётчик
+	learned   map[string]bool
+}
+
+func NewPassthroughUsecase(patterns []string, threshold int) usecase.PassthroughUsecase {
+	return &Passthrough{
+		patterns:  patterns,
+		threshold: threshold,
+		failures:  make(map[string]int),
+		learned:   make(map[string]bool),
+	}
+}
+
+func (p *Passthrough) Passthrough(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.learned[host] {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if entity.MatchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Configure заменяет список хостов и порог отказов. Хосты, добавленные автоматически, и счётчики отказов
+// сбрасываются: они набраны по старым правилам
+func (p *Passthrough) Configure(patterns []string, threshold int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.patterns, p.threshold = patterns, threshold
+	p.failures = make(map[string]int)
+	p.learned = make(map[string]bool)
+}
+
+// ReportHandshakeSuccess обнуляет счётчик отказов: клиент принял сертификат, значит, прежние отказы были случайными
+func (p *Passthrough) ReportHandshakeSuccess(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failures, host)
+}
+
+func (p *Passthrough) ReportHandshakeFailure(host string, err error) {
+	if !isCertificateRejection(err) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.threshold <= 0 {
+		return
+	}
+	p.failures[host]++
+	if p.failures[host] >= p.threshold && !p.learned[host] {
+		p.learned[host] = true
+		slog.Info("Клиент отверг сертификат, хост добавлен в TLS passthrough", "host", host, "failures", p.failures[host])
+	}
+}
+
+// isCertificateRejection отличает отказ клиента от поддельного сертификата от прочих ошибок рукопожатия:
+// считается только TLS alert клиента о сертификате. Обрыв соединения (EOF, ECONNRESET) бывает по любой причине,
+// поэтому не учитывается. crypto/tls не экспортирует тип alert, и полученный alert доступен только как
+// net.OpError с Op "remote error" и текстом alert
+func isCertificateRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	msg := opErr.Err.Error()
+	for _, alert := range []string{"bad certificate", "unknown certificate authority", "certificate unknown", "unsupported certificate"} {
+		if strings.Contains(msg, alert) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,39 +3,88 @@ package service
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/logging"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
 	"github.com/blackHATred/mitm_proxy/internal/usecase"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 type Proxy struct {
-	historyUsecase usecase.HistoryUsecase
+	historyUsecase     usecase.HistoryUsecase
+	rewriteUsecase     usecase.RewriteUsecase
+	interceptUsecase   usecase.InterceptUsecase
+	scopeUsecase       usecase.ScopeUsecase
+	passthroughUsecase usecase.PassthroughUsecase
+	upstreamUsecase    usecase.UpstreamUsecase
+	proxyAuthUsecase   usecase.ProxyAuthUsecase
+	// логин и пароль для SOCKS-клиентов, nil - без аутентификации
+	socksUser *url.Userinfo
+	timeouts  entity.Timeouts
 }
 
-func NewProxyService(historyUC usecase.HistoryUsecase) usecase.ProxyUsecase {
+func NewProxyService(historyUC usecase.HistoryUsecase, rewriteUC usecase.RewriteUsecase, interceptUC usecase.InterceptUsecase, scopeUC usecase.ScopeUsecase, passthroughUC usecase.PassthroughUsecase, upstreamUC usecase.UpstreamUsecase, proxyAuthUC usecase.ProxyAuthUsecase, socksUser *url.Userinfo, timeouts entity.Timeouts) usecase.ProxyUsecase {
 	return Proxy{
-		historyUsecase: historyUC,
+		historyUsecase:     historyUC,
+		rewriteUsecase:     rewriteUC,
+		interceptUsecase:   interceptUC,
+		scopeUsecase:       scopeUC,
+		passthroughUsecase: passthroughUC,
+		upstreamUsecase:    upstreamUC,
+		proxyAuthUsecase:   proxyAuthUC,
+		socksUser:          socksUser,
+		timeouts:           timeouts,
 	}
 }
 
 func (p Proxy) HandleConn(conn net.Conn) error {
 	defer conn.Close()
-	// чтение первого запроса клиента
-	request, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		return fmt.Errorf("ошибка чтения запроса: %s", err)
-	}
+	// один reader на всё соединение: в его буфере могут оказаться следующие запросы клиента (pipelining)
+	wire := newWireReader(conn, nil)
+	for {
+		request, err := readRequest(connContext(conn), conn, wire, p.timeouts)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			rejectMalformed(conn, err)
+			return fmt.Errorf("ошибка чтения запроса: %s", err)
+		}
+
+		user, ok := p.authenticate(request)
+		if !ok {
+			err = proxyAuthRequired(request).Write(conn)
+			if err != nil {
+				return fmt.Errorf("ошибка отправки ответа клиенту: %s", err)
+			}
+			return fmt.Errorf("клиент %s не прошёл аутентификацию на прокси", conn.RemoteAddr())
+		}
+		// учётные данные прокси не должны уйти на сервер
+		request.Header.Del("Proxy-Authorization")
+		request = request.WithContext(withProxyUser(request.Context(), user))
 
-	// если это HTTPS-запрос (CONNECT), то обрабатываем его отдельно
-	if request.Method == http.MethodConnect {
-		return p.HandleHTTPSConnect(conn, request)
+		// если это HTTPS-запрос (CONNECT), то обрабатываем его отдельно
+		if request.Method == http.MethodConnect {
+			// клиент мог отправить начало рукопожатия, не дожидаясь ответа на CONNECT: эти байты уже в буфере reader
+			client := &bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(wire.buffered()), conn)}
+			return p.HandleHTTPSConnect(client, request)
+		}
+		keep, err := p.HandleHTTPRequest(conn, request)
+		if err != nil || !keep {
+			return err
+		}
 	}
-	return p.HandleHTTPRequest(conn, request, nil)
 }
 
 func (p Proxy) GetTLSConfig(host string) (*tls.Config, error) {
@@ -51,76 +100,482 @@ func (p Proxy) GetTLSConfig(host string) (*tls.Config, error) {
 }
 
 func (p Proxy) HandleHTTPSConnect(conn net.Conn, req *http.Request) error {
+	if !p.scopeUsecase.InScopeHost("https", req.Host) {
+		// хосты вне scope не расшифровываем
+		return p.Tunnel(conn, req.Host)
+	}
+	if p.passthroughUsecase.Passthrough(req.URL.Hostname()) {
+		// содержимое туннеля недоступно, поэтому в историю попадают только сведения о CONNECT
+		_, err := p.historyUsecase.AddHistory(req, nil, entity.HistoryMeta{
+			Passthrough: true,
+			User:        proxyUser(req.Context()),
+			Connection:  connectionInfo(conn.RemoteAddr(), nil, nil),
+		})
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Ошибка сохранения истории запроса", "error", err)
+		}
+		return p.Tunnel(conn, req.Host)
+	}
+
 	// туннель установлен
 	_, err := fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
 	if err != nil {
 		return fmt.Errorf("ошибка отправки подтверждения CONNECT: %s", err)
 	}
+	return p.serveTLS(req.Context(), conn, req.URL.Hostname())
+}
 
-	// установка TLS-туннеля
-	tlsCfg, err := p.GetTLSConfig(req.URL.Hostname())
+// serveTLS расшифровывает TLS-соединение клиента поддельным сертификатом для host и обрабатывает запросы внутри него.
+// Запросы получают контекст ctx, в котором лежат сведения о соединении (например, пользователь прокси)
+func (p Proxy) serveTLS(ctx context.Context, conn net.Conn, host string) error {
+	tlsCfg, err := p.GetTLSConfig(host)
 	if err != nil {
 		return fmt.Errorf("ошибка получения TLS-конфигурации: %s", err)
 	}
 	tlsConn := tls.Server(conn, tlsCfg)
 	defer tlsConn.Close()
+	// рукопожатие ограничено тем же таймаутом, что и чтение заголовков запроса
+	_ = conn.SetDeadline(entity.Deadline(p.timeouts.ReadHeader))
+	err = tlsConn.Handshake()
+	if err != nil {
+		p.passthroughUsecase.ReportHandshakeFailure(host, err)
+		return fmt.Errorf("ошибка TLS-рукопожатия с клиентом: %s", err)
+	}
+	p.passthroughUsecase.ReportHandshakeSuccess(host)
+	_ = conn.SetDeadline(time.Time{})
 
 	// чтение трафика
+	reader := newWireReader(tlsConn, nil)
 	for {
-		request, err := http.ReadRequest(bufio.NewReader(tlsConn))
+		request, err := readRequest(ctx, tlsConn, reader, p.timeouts)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			rejectMalformed(tlsConn, err)
 			return fmt.Errorf("ошибка чтения HTTPS-запроса: %s", err)
 		}
-		err = p.HandleHTTPRequest(tlsConn, request, tlsCfg)
+		keep, err := p.HandleHTTPRequest(tlsConn, request)
 		if err != nil {
 			return fmt.Errorf("ошибка обработки HTTPS-запроса: %s", err)
 		}
+		if !keep {
+			break
+		}
 	}
 
 	return nil
 }
 
-func (p Proxy) HandleHTTPRequest(conn net.Conn, request *http.Request, tlsCfg *tls.Config) error {
-	log.Println(request.Method, request.Host, request.RequestURI)
+// HandleStream обрабатывает поток к addr, протокол которого заранее неизвестен (SOCKS, прозрачный режим):
+// TLS расшифровывается, открытый HTTP обрабатывается как обычно, всё остальное пересылается без изменений
+func (p Proxy) HandleStream(conn net.Conn, addr string) error {
+	return p.handleStream(connContext(conn), conn, addr)
+}
+
+func (p Proxy) handleStream(ctx context.Context, conn net.Conn, addr string) error {
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(entity.Deadline(p.timeouts.Idle))
+	first, err := reader.Peek(1)
+	if err != nil {
+		if err == io.EOF || isTimeout(err) {
+			return nil
+		}
+		return fmt.Errorf("ошибка чтения потока: %s", err)
+	}
+
+	if first[0] == tlsRecordHandshake {
+		hello, raw, err := readClientHello(reader)
+		client := &bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(raw), reader)}
+		if err != nil {
+			// это не TLS - пересылаем как есть
+			return p.relay(client, addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("некорректный адрес назначения %s: %s", addr, err)
+		}
+		if hello.ServerName != "" {
+			// сертификат выбирается по SNI: адрес назначения может быть просто IP
+			host = hello.ServerName
+		}
+		hostport := net.JoinHostPort(host, port)
+		if !p.scopeUsecase.InScopeHost("https", hostport) {
+			return p.relay(client, addr)
+		}
+		if p.passthroughUsecase.Passthrough(host) {
+			// у нерасшифрованного потока один обмен - само соединение
+			connect := connectRequest(hostport).WithContext(logging.WithExchangeID(ctx, logging.NewID()))
+			_, err := p.historyUsecase.AddHistory(connect, nil, entity.HistoryMeta{
+				Passthrough: true,
+				User:        proxyUser(ctx),
+				Connection:  connectionInfo(conn.RemoteAddr(), nil, nil),
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "Ошибка сохранения истории запроса", "error", err)
+			}
+			return p.relay(client, addr)
+		}
+		return p.serveTLS(ctx, client, host)
+	}
+
+	client := &bufferedConn{Conn: conn, reader: reader}
+	if !looksLikeHTTP(conn, reader, p.timeouts.ReadHeader) {
+		return p.relay(client, addr)
+	}
+	wire := newWireReader(conn, reader)
+	for {
+		request, err := readRequest(ctx, client, wire, p.timeouts)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			rejectMalformed(client, err)
+			return fmt.Errorf("ошибка чтения запроса: %s", err)
+		}
+		if request.URL.Host == "" {
+			// в потоке запросы приходят с путём, а не с абсолютным URL, как к обычному прокси
+			request.URL.Scheme = "http"
+			request.URL.Host = streamHost(request.Host, addr)
+		}
+		keep, err := p.HandleHTTPRequest(client, request)
+		if err != nil {
+			return fmt.Errorf("ошибка обработки запроса: %s", err)
+		}
+		if !keep {
+			return nil
+		}
+	}
+}
+
+// HandleTransparentConn обрабатывает соединение, перенаправленное на прокси средствами iptables, без CONNECT и SOCKS:
+// адрес назначения восстанавливается из SO_ORIGINAL_DST
+func (p Proxy) HandleTransparentConn(conn net.Conn) error {
+	defer conn.Close()
+	addr, err := originalDst(conn)
+	if err != nil {
+		return fmt.Errorf("ошибка определения исходного адреса назначения: %s", err)
+	}
+	if addr == conn.LocalAddr().String() {
+		// клиент подключился к прозрачному прокси напрямую - пересылка самому себе зациклится
+		return fmt.Errorf("соединение от %s пришло без перенаправления", conn.RemoteAddr())
+	}
+	return p.HandleStream(conn, addr)
+}
+
+// streamHost возвращает хост из заголовка Host с портом из адреса назначения, а без заголовка - сам адрес
+func streamHost(host, addr string) string {
+	if host == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "80" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// connectRequest описывает соединение, содержимое которого недоступно, в виде CONNECT-запроса для истории
+func connectRequest(hostport string) *http.Request {
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: hostport},
+		Host:       hostport,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+}
+
+// HandleHTTPRequest обрабатывает запрос клиента и отправляет ему ответ.
+// Возвращает false, если после этого ответа соединение с клиентом нужно закрыть
+func (p Proxy) HandleHTTPRequest(conn net.Conn, request *http.Request) (bool, error) {
+	defer endExchange(conn)
+	slog.DebugContext(request.Context(), "Запрос клиента", "method", request.Method, "host", request.Host, "uri", request.RequestURI)
 	request.Header.Del("Proxy-Connection")
 	request.Header.Del("Accept-Encoding")
-	var err error
-	var dial net.Conn
-	if tlsCfg != nil {
-		dial, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", request.Host, 443), tlsCfg)
-	} else {
-		port := "80"
-		if request.URL.Port() != "" {
-			port = request.URL.Port()
+
+	// трафик вне scope проходит через прокси как есть: без правил, перехвата и сохранения в историю
+	u, err := url.Parse(requestURL(request))
+	if err != nil {
+		rejectMalformed(conn, err)
+		return false, fmt.Errorf("ошибка разбора URL запроса: %s", err)
+	}
+	inScope := p.scopeUsecase.InScope(u)
+
+	var appliedRules []string
+	var response *http.Response
+	// ошибка подключения к серверу или обмена с ним
+	var exchangeErr error
+	// разбивка времени обмена, nil - если к серверу не обращались
+	var timing *entity.Timing
+	// адрес сервера и параметры TLS дополняются после подключения
+	connection := connectionInfo(conn.RemoteAddr(), nil, nil)
+	// ответ сервера в том виде, в котором он пришёл
+	var rawResponse []byte
+	// ответ пересылается клиенту по мере получения
+	var streaming bool
+	if inScope {
+		appliedRules, err = p.rewriteUsecase.ApplyRequest(request)
+		if err != nil {
+			return false, fmt.Errorf("ошибка применения правил к запросу: %s", err)
+		}
+
+		request, response, err = p.interceptUsecase.InterceptRequest(request)
+		if err != nil {
+			return false, fmt.Errorf("ошибка перехвата запроса: %w", err)
 		}
-		dial, err = net.Dial("tcp", fmt.Sprintf("%s:%s", request.URL.Hostname(), port))
 	}
+	// адрес сервера берётся из запроса после правил и перехвата: они могли его изменить
+	target, err := url.Parse(requestURL(request))
 	if err != nil {
-		return fmt.Errorf("ошибка подключения к хосту: %s", err)
+		rejectMalformed(conn, err)
+		return false, fmt.Errorf("ошибка разбора URL запроса: %s", err)
 	}
-	response, err := p.SendRequest(dial, request)
-	if err != nil {
-		return fmt.Errorf("ошибка отправки запроса: %s", err)
+	// запрос, который правила или перехват увели за пределы scope, дальше обрабатывается как трафик вне scope
+	inScope = inScope && p.scopeUsecase.InScope(target)
+	// если при перехвате ответ был задан вручную, к серверу не обращаемся
+	if response == nil {
+		recorder := newTimingRecorder()
+		request = request.WithContext(p.withInterimRelay(recorder.withTrace(request.Context()), conn, request))
+		var dial net.Conn
+		var state *tls.ConnectionState
+		var forward *entity.ForwardProxy
+		if target.Scheme == "https" {
+			var tlsDial *tls.Conn
+			tlsDial, err = p.upstreamUsecase.DialTLS(request.Context(), upstreamAddr(target.Host, "443"), target.Hostname(), true)
+			if err == nil {
+				cs := tlsDial.ConnectionState()
+				dial, state = tlsDial, &cs
+			}
+		} else {
+			dial, forward, err = p.upstreamUsecase.DialHTTP(request.Context(), upstreamAddr(target.Host, "80"))
+		}
+		if err != nil {
+			exchangeErr = fmt.Errorf("ошибка подключения к хосту: %w", err)
+		} else {
+			defer dial.Close()
+			connection = connectionInfo(conn.RemoteAddr(), dial.RemoteAddr(), state)
+			// при принудительной остановке прокси обмен с сервером прерывается вместе с соединением клиента
+			stop := context.AfterFunc(request.Context(), func() { _ = dial.Close() })
+			defer stop()
+			// исходные байты ответа нужны только для истории, поэтому запоминаются только в scope
+			upstream := dial
+			wire := &wireConn{Conn: dial}
+			if inScope {
+				upstream = wire
+			}
+			response, err = p.SendRequest(upstream, request, forward)
+			if err != nil {
+				exchangeErr = fmt.Errorf("ошибка отправки запроса: %w", err)
+			} else if inScope {
+				// тело всё равно сохраняется в историю целиком, а прочитав его сразу, получаем время передачи.
+				// Поток событий, длинный опрос и другие тела, которые не закончились сразу, пересылаются клиенту
+				// по мере получения, а их исходные байты не запоминаются
+				streaming = entity.IsEventStream(response)
+				if !streaming {
+					complete, err := bufferResponse(response, bufferWindow, maxBufferedBody)
+					if err != nil {
+						exchangeErr = fmt.Errorf("ошибка чтения ответа: %w", err)
+					}
+					streaming = err == nil && !complete
+				}
+				if streaming {
+					wire.detach()
+				} else {
+					rawResponse = wire.captured()
+				}
+			}
+		}
+		timing = recorder.timing(time.Now())
+		observeTiming(timing)
+		if exchangeErr != nil {
+			// вместо разорванного соединения клиент получает ответ с описанием ошибки
+			slog.WarnContext(request.Context(), "Ошибка обмена с сервером", "host", target.Host, "error", exchangeErr)
+			response = errorResponse(request, upstreamErrorStatus(exchangeErr), exchangeErr)
+		} else {
+			rewriteReverseResponse(request, response)
+		}
 	}
 
-	// сохраняем историю запроса
-	err = p.historyUsecase.AddHistory(request, response)
+	// байты запроса забираются у любого запроса, иначе они достанутся следующему запросу в соединении
+	rawRequest, err := wireRequest(request)
 	if err != nil {
-		log.Printf("Ошибка сохранения истории запроса: %s", err)
+		return false, fmt.Errorf("ошибка чтения запроса: %s", err)
+	}
+	raw := &entity.RawExchange{Request: rawRequest, Response: rawResponse}
+	metrics.Requests.WithLabelValues(metrics.HostLabel(target.Hostname(), inScope), strconv.Itoa(response.StatusCode)).Inc()
+
+	if inScope && exchangeErr != nil {
+		// ответа сервера нет, поэтому правила и перехват ответа не применяются, а в историю попадает только ошибка
+		_, err = p.historyUsecase.AddHistory(request, nil, entity.HistoryMeta{
+			AppliedRules: appliedRules,
+			User:         proxyUser(request.Context()),
+			Error:        exchangeErr.Error(),
+			Timing:       timing,
+			Connection:   connection,
+			Raw:          raw,
+		})
+		if err != nil {
+			slog.ErrorContext(request.Context(), "Ошибка сохранения истории запроса", "error", err)
+		}
+	} else if inScope && streaming {
+		return p.relayStream(conn, request, response, entity.HistoryMeta{
+			AppliedRules: appliedRules,
+			User:         proxyUser(request.Context()),
+			Timing:       timing,
+			Connection:   connection,
+			Raw:          raw,
+		})
+	} else if inScope {
+		applied, err := p.rewriteUsecase.ApplyResponse(request, response)
+		if err != nil {
+			return false, fmt.Errorf("ошибка применения правил к ответу: %s", err)
+		}
+		appliedRules = append(appliedRules, applied...)
+
+		response, err = p.interceptUsecase.InterceptResponse(request, response)
+		if err != nil {
+			return false, fmt.Errorf("ошибка перехвата ответа: %w", err)
+		}
+
+		// сохраняем историю запроса
+		_, err = p.historyUsecase.AddHistory(request, response, entity.HistoryMeta{
+			AppliedRules: appliedRules,
+			User:         proxyUser(request.Context()),
+			Timing:       timing,
+			Connection:   connection,
+			Raw:          raw,
+		})
+		if err != nil {
+			slog.ErrorContext(request.Context(), "Ошибка сохранения истории запроса", "error", err)
+		}
 	}
 
 	// отправляем ответ клиенту
-	err = response.Write(conn)
+	err = p.writeResponse(conn, response)
+	if err != nil {
+		return false, fmt.Errorf("ошибка отправки ответа клиенту: %s", err)
+	}
+	slog.DebugContext(request.Context(), "Ответ отправлен клиенту", "status", response.StatusCode)
+	return keepAlive(request, response), nil
+}
+
+// Tunnel соединяет клиента с хостом напрямую и пересылает байты в обе стороны без расшифровки
+func (p Proxy) Tunnel(conn net.Conn, addr string) error {
+	_, err := fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		return fmt.Errorf("ошибка отправки подтверждения CONNECT: %s", err)
+	}
+	return p.relay(conn, addr)
+}
+
+// relay подключается к addr и пересылает байты между ним и клиентом, пока одна из сторон не закроет соединение
+func (p Proxy) relay(conn net.Conn, addr string) error {
+	// туннель может простаивать сколько угодно: таймауты HTTP к нему не относятся
+	_ = conn.SetDeadline(time.Time{})
+	upstream, err := p.upstreamUsecase.Dial(connContext(conn), addr)
 	if err != nil {
-		return fmt.Errorf("ошибка отправки ответа клиенту: %s", err)
+		return fmt.Errorf("ошибка подключения к хосту: %s", err)
 	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	// как только одна из сторон закрыла соединение, туннель больше не нужен
+	<-done
 	return nil
 }
 
-func (p Proxy) SendRequest(dial net.Conn, req *http.Request) (*http.Response, error) {
+// writeForward отправляет запрос вышестоящему HTTP-прокси в абсолютной форме. Заголовок Proxy-Authorization
+// добавляется только к отправленной копии запроса, чтобы учётные данные прокси не попали в историю
+func writeForward(dial net.Conn, req *http.Request, forward *entity.ForwardProxy) error {
+	out := *req
+	target := *req.URL
+	if target.Scheme == "" {
+		// у запросов прозрачного и обратного прокси URL может быть в относительной форме
+		target.Scheme = "http"
+	}
+	out.URL = &target
+	out.Header = req.Header.Clone()
+	if forward.Authorization != "" {
+		out.Header.Set("Proxy-Authorization", forward.Authorization)
+	}
+	return out.WriteProxy(dial)
+}
+
+// endExchange сообщает соединению слушателя, что обмен закончен и окончательный ответ клиенту отправлен.
+// Соединение может быть обёрнуто, например, в TLS, поэтому обёртки снимаются, пока не найдётся то, что умеет EndExchange
+func endExchange(conn net.Conn) {
+	for {
+		if c, ok := conn.(interface{ EndExchange() }); ok {
+			c.EndExchange()
+			return
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// readRequest читает очередной запрос клиента с учётом таймаутов и возвращает его с контекстом ctx.
+// Если клиент не начал новый запрос за время Idle, соединение считается завершённым и возвращается io.EOF
+func readRequest(ctx context.Context, conn net.Conn, reader *wireReader, timeouts entity.Timeouts) (*http.Request, error) {
+	_ = conn.SetReadDeadline(entity.Deadline(timeouts.Idle))
+	_, err := reader.Peek(1)
+	if isTimeout(err) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(entity.Deadline(timeouts.ReadHeader))
+	request, err := http.ReadRequest(reader.Reader)
+	if err != nil {
+		return nil, err
+	}
+	// у каждого запроса свой идентификатор обмена, по нему запись лога связывается с записью в истории
+	ctx = logging.WithExchangeID(ctx, logging.NewID())
+	request = request.WithContext(context.WithValue(ctx, wireReaderKey{}, reader))
+	expectContinue(conn, request, timeouts)
+	// тело дочитывается позже (правилами, перехватом или при отправке на сервер), но не дольше Read от начала запроса
+	var deadline time.Time
+	if timeouts.Read > 0 {
+		deadline = start.Add(timeouts.Read)
+	}
+	_ = conn.SetReadDeadline(deadline)
+	return request, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamAddr дополняет адрес хоста портом по умолчанию, если порт не указан явно
+func upstreamAddr(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (p Proxy) SendRequest(dial net.Conn, req *http.Request, forward *entity.ForwardProxy) (*http.Response, error) {
 	// чтобы тело можно было читать повторно в других местах
 	if req.Body != nil {
 		buf, err := io.ReadAll(req.Body)
@@ -130,16 +585,34 @@ func (p Proxy) SendRequest(dial net.Conn, req *http.Request) (*http.Response, er
 		req.Body = io.NopCloser(bytes.NewBuffer(buf))
 	}
 
+	// запрос отправляется в обход http.Transport, поэтому о событиях трассировки сообщаем сами
+	trace := httptrace.ContextClientTrace(req.Context())
+
 	// отправка запроса
-	err := req.Write(dial)
+	var err error
+	if forward != nil {
+		err = writeForward(dial, req, forward)
+	} else {
+		err = req.Write(dial)
+	}
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Ошибка отправки запроса: %s", err))
+		return nil, fmt.Errorf("Ошибка отправки запроса: %w", err)
+	}
+	if trace != nil && trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{})
 	}
 
 	// чтение ответа
-	response, err := http.ReadResponse(bufio.NewReader(dial), req)
+	_ = dial.SetReadDeadline(entity.Deadline(p.timeouts.ResponseHeader))
+	reader := bufio.NewReader(dial)
+	if _, err := reader.Peek(1); err == nil && trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+	response, err := readResponse(reader, req)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Ошибка чтения ответа: %s", err))
+		return nil, fmt.Errorf("Ошибка чтения ответа: %w", err)
 	}
+	// тело может быть большим или приходить частями, поэтому его чтение не ограничиваем
+	_ = dial.SetReadDeadline(time.Time{})
 	return response, nil
 }
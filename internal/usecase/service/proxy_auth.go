@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type ProxyAuth struct {
+	users map[string]string
+}
+
+// NewProxyAuthUsecase загружает пользователей прокси из файла (строки вида user:password) и из списка с теми же строками.
+// Если пользователей нет, аутентификация отключена
+func NewProxyAuthUsecase(filename string, users []string) (usecase.ProxyAuthUsecase, error) {
+	credentials, err := loadCredentials(filename, users)
+	if err != nil {
+		return nil, fmt.Errorf("пользователи прокси: %s", err)
+	}
+	return &ProxyAuth{users: credentials}, nil
+}
+
+// loadCredentials читает пользователей из файла со строками user:password и добавляет к ним users в том же формате
+func loadCredentials(filename string, users []string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	if filename != "" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла пользователей: %s", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			users = append(users, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла пользователей: %s", err)
+		}
+	}
+
+	for _, user := range users {
+		name, password, ok := strings.Cut(user, ":")
+		if !ok || name == "" {
+			return nil, errors.New("пользователь должен быть задан в виде user:password")
+		}
+		credentials[name] = password
+	}
+	return credentials, nil
+}
+
+// checkPassword сравнивает пароль с сохранённым, который может быть открытым текстом или bcrypt-хешем
+func checkPassword(expected, password string) bool {
+	if strings.HasPrefix(expected, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+func (a *ProxyAuth) Enabled() bool {
+	return len(a.users) > 0
+}
+
+func (a *ProxyAuth) Authenticate(username, password string) bool {
+	expected, ok := a.users[username]
+	return ok && checkPassword(expected, password)
+}
+
+type proxyUserKey struct{}
+
+func withProxyUser(ctx context.Context, user string) context.Context {
+	if user == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyUserKey{}, user)
+}
+
+// proxyUser возвращает пользователя прокси, от имени которого пришёл запрос
+func proxyUser(ctx context.Context) string {
+	user, _ := ctx.Value(proxyUserKey{}).(string)
+	return user
+}
+
+// authenticate проверяет заголовок Proxy-Authorization и возвращает имя пользователя
+func (p Proxy) authenticate(req *http.Request) (string, bool) {
+	if !p.proxyAuthUsecase.Enabled() {
+		return "", true
+	}
+	encoded, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !p.proxyAuthUsecase.Authenticate(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+func proxyAuthRequired(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Proxy-Authenticate": {`Basic realm="mitm_proxy"`},
+		},
+		Body:    http.NoBody,
+		Close:   true,
+		Request: req,
+	}
+}
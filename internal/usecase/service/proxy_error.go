@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>{{.Code}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+{{if .URL}}<p>URL: {{.URL}}</p>{{end}}
+<hr>
+<p>mitm_proxy</p>
+</body>
+</html>
+`))
+
+type proxyError struct {
+	Code    int    `json:"status"`
+	Status  string `json:"error"`
+	Message string `json:"message"`
+	URL     string `json:"url,omitempty"`
+}
+
+// upstreamErrorStatus выбирает код ответа клиенту по ошибке обмена с сервером:
+// 504 - если сервер не ответил вовремя, 502 - во всех остальных случаях
+func upstreamErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// errorResponse формирует ответ прокси с описанием ошибки. Тело - JSON, если клиент его явно просит, иначе HTML.
+// req может быть nil, если запрос не удалось разобрать
+func errorResponse(req *http.Request, code int, cause error) *http.Response {
+	data := proxyError{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: cause.Error(),
+	}
+	if req != nil && req.Method != http.MethodConnect {
+		data.URL = requestURL(req)
+	}
+
+	var body bytes.Buffer
+	contentType := "text/html; charset=utf-8"
+	if req != nil && wantsJSON(req) {
+		contentType = "application/json"
+		_ = json.NewEncoder(&body).Encode(data)
+	} else {
+		_ = errorPage.Execute(&body, data)
+	}
+
+	return &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":           {contentType},
+			"Cache-Control":          {"no-store"},
+			"X-Content-Type-Options": {"nosniff"},
+		},
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		// после некорректного запроса границы следующего в потоке неизвестны
+		Close:   req == nil,
+		Request: req,
+	}
+}
+
+func wantsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// rejectMalformed отвечает клиенту 400 на запрос, который не удалось разобрать.
+// Если соединение просто оборвалось, отвечать уже некому
+func rejectMalformed(conn net.Conn, err error) {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return
+	}
+	_ = errorResponse(nil, http.StatusBadRequest, err).Write(conn)
+}
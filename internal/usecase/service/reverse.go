@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Reverse struct {
+	proxyUsecase usecase.ProxyUsecase
+	upstream     *url.URL
+	// переписывать ли Location и домены cookies сервера на адрес, по которому к прокси обращается клиент
+	rewrite  bool
+	timeouts entity.Timeouts
+}
+
+func NewReverseUsecase(proxyUC usecase.ProxyUsecase, upstream string, rewrite bool, timeouts entity.Timeouts) (usecase.ReverseUsecase, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный адрес сервера для обратного прокси: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("адрес сервера для обратного прокси должен быть вида http(s)://host[:port][/path]: %s", upstream)
+	}
+	return &Reverse{
+		proxyUsecase: proxyUC,
+		upstream:     u,
+		rewrite:      rewrite,
+		timeouts:     timeouts,
+	}, nil
+}
+
+// reverseTarget передаётся в контексте запроса, чтобы HandleHTTPRequest мог переписать ответ сервера
+type reverseTarget struct {
+	origin   *url.URL
+	upstream *url.URL
+}
+
+type reverseTargetKey struct{}
+
+// HandleConn принимает соединение клиента, открытое или TLS (определяется по первому байту),
+// и отправляет все запросы из него на настроенный сервер
+func (r *Reverse) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(entity.Deadline(r.timeouts.Idle))
+	first, err := reader.Peek(1)
+	if err != nil {
+		if err == io.EOF || isTimeout(err) {
+			return nil
+		}
+		return fmt.Errorf("ошибка чтения запроса: %s", err)
+	}
+
+	scheme := "http"
+	var tlsCfg *tls.Config
+	client := net.Conn(conn)
+	var wire *wireReader
+	if first[0] == tlsRecordHandshake {
+		hello, raw, err := readClientHello(reader)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения ClientHello: %s", err)
+		}
+		host := r.upstream.Hostname()
+		if hello.ServerName != "" {
+			host = hello.ServerName
+		}
+		tlsCfg, err = r.proxyUsecase.GetTLSConfig(host)
+		if err != nil {
+			return fmt.Errorf("ошибка получения TLS-конфигурации: %s", err)
+		}
+		tlsConn := tls.Server(&bufferedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(raw), reader)}, tlsCfg)
+		_ = conn.SetDeadline(entity.Deadline(r.timeouts.ReadHeader))
+		err = tlsConn.Handshake()
+		if err != nil {
+			return fmt.Errorf("ошибка TLS-рукопожатия с клиентом: %s", err)
+		}
+		_ = conn.SetDeadline(time.Time{})
+		scheme = "https"
+		client = tlsConn
+		wire = newWireReader(tlsConn, nil)
+	} else {
+		wire = newWireReader(conn, reader)
+	}
+
+	for {
+		request, err := readRequest(connContext(conn), client, wire, r.timeouts)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			rejectMalformed(client, err)
+			return fmt.Errorf("ошибка чтения запроса: %s", err)
+		}
+		request = r.rewriteRequest(request, scheme, conn.RemoteAddr())
+		keep, err := r.proxyUsecase.HandleHTTPRequest(client, request)
+		if err != nil {
+			return fmt.Errorf("ошибка обработки запроса: %s", err)
+		}
+		if !keep {
+			return nil
+		}
+	}
+}
+
+// rewriteRequest направляет запрос клиента на сервер: URL строится от базового адреса, Host заменяется на хост сервера
+func (r *Reverse) rewriteRequest(req *http.Request, scheme string, remote net.Addr) *http.Request {
+	origin := &url.URL{Scheme: scheme, Host: req.Host}
+
+	target := *req.URL
+	target.Scheme = r.upstream.Scheme
+	target.Host = r.upstream.Host
+	target.Path = joinPath(r.upstream.Path, req.URL.Path)
+	target.RawPath = ""
+	req.URL = &target
+	req.Host = r.upstream.Host
+
+	req.Header.Set("X-Forwarded-Host", origin.Host)
+	req.Header.Set("X-Forwarded-Proto", scheme)
+	if ip, _, err := net.SplitHostPort(remote.String()); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+
+	if !r.rewrite {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), reverseTargetKey{}, &reverseTarget{
+		origin:   origin,
+		upstream: r.upstream,
+	}))
+}
+
+func joinPath(base, path string) string {
+	if base == "" || base == "/" {
+		return path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// rewriteReverseResponse заменяет в ответе сервера его адрес на адрес прокси: в Location и в атрибуте Domain у cookies.
+// Для запросов, пришедших не через обратный прокси, ничего не делает
+func rewriteReverseResponse(req *http.Request, res *http.Response) {
+	target, ok := req.Context().Value(reverseTargetKey{}).(*reverseTarget)
+	if !ok {
+		return
+	}
+
+	if location := res.Header.Get("Location"); location != "" {
+		res.Header.Set("Location", target.rewriteLocation(location))
+	}
+	cookies := res.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = target.rewriteCookieDomain(cookie)
+	}
+}
+
+func (t *reverseTarget) rewriteLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || (u.Host != "" && !strings.EqualFold(u.Host, t.upstream.Host)) {
+		return location
+	}
+	if u.Host != "" {
+		u.Scheme = t.origin.Scheme
+		u.Host = t.origin.Host
+	}
+	// путь базового адреса сервера клиенту не виден
+	base := strings.TrimSuffix(t.upstream.Path, "/")
+	if base != "" && (u.Path == base || strings.HasPrefix(u.Path, base+"/")) {
+		u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, base), "/")
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// rewriteCookieDomain убирает атрибут Domain, выставленный для домена сервера:
+// без него браузер привяжет cookie к хосту прокси
+func (t *reverseTarget) rewriteCookieDomain(cookie string) string {
+	host := strings.ToLower(t.upstream.Hostname())
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(name, "domain") {
+			domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(value), "."))
+			if domain == host || strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
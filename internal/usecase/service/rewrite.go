@@ -0,0 +1,331 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type compiledRule struct {
+	entity.RewriteRule
+	path    *regexp.Regexp
+	pattern *regexp.Regexp
+	// правила из конфигурации не сохраняются в файл: при перезагрузке они снова берутся из неё
+	fromConfig bool
+}
+
+type Rewrite struct {
+	mu       sync.RWMutex
+	filename string
+	rules    []compiledRule
+}
+
+func NewRewriteUsecase(rules []entity.RewriteRule, filename string) (usecase.RewriteUsecase, error) {
+	r := &Rewrite{}
+	err := r.Reload(rules, filename)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload заменяет правила правилами из конфигурации и файла, дальнейшие изменения из веб-интерфейса сохраняются
+// в этот файл. Если правила или файл некорректны, остаются прежние правила и прежний файл
+func (r *Rewrite) Reload(rules []entity.RewriteRule, filename string) error {
+	compiled := make([]compiledRule, 0)
+	for i, rule := range rules {
+		if rule.ID == "" {
+			// по идентификатору правило включают и удаляют из веб-интерфейса, поэтому он не меняется при перезагрузке
+			rule.ID = fmt.Sprintf("config-%d", i+1)
+		}
+		c, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("правило %q: %s", rule.Name, err)
+		}
+		c.fromConfig = true
+		compiled = append(compiled, c)
+	}
+
+	// файла может ещё не быть - он будет создан при первом изменении правил из веб-интерфейса
+	var fileRules []entity.RewriteRule
+	err := readJSONFile(filename, &fileRules)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки файла правил: %s", err)
+	}
+	for _, rule := range fileRules {
+		if rule.ID == "" {
+			rule.ID = strings.ToLower(randomString(8))
+		}
+		c, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("правило %q: %s", rule.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.filename, r.rules = filename, compiled
+	return nil
+}
+
+func compileRule(rule entity.RewriteRule) (compiledRule, error) {
+	c := compiledRule{RewriteRule: rule}
+	err := rule.Validate()
+	if err != nil {
+		return c, err
+	}
+	// выражения уже проверены в Validate
+	if rule.Path != "" {
+		c.path = regexp.MustCompile(rule.Path)
+	}
+	if rule.Pattern != "" {
+		c.pattern = regexp.MustCompile(rule.Pattern)
+	}
+	return c, nil
+}
+
+func (c *compiledRule) matches(req *http.Request, direction entity.RuleDirection) bool {
+	if !c.Enabled || c.Direction != direction {
+		return false
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if !entity.MatchHostPattern(c.Host, host) {
+		return false
+	}
+	if c.Method != "" && !strings.EqualFold(c.Method, req.Method) {
+		return false
+	}
+	return c.path == nil || c.path.MatchString(req.URL.Path)
+}
+
+func (c *compiledRule) title() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
+}
+
+func (r *Rewrite) ApplyRequest(req *http.Request) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	applied := make([]string, 0)
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(req, entity.RuleDirectionRequest) {
+			continue
+		}
+
+		var changed bool
+		switch rule.Action {
+		case entity.RuleActionReplaceURL:
+			u := req.URL.String()
+			if req.URL.Host == "" {
+				// внутри TLS-туннеля в запросе только путь
+				u = fmt.Sprintf("https://%s%s", req.Host, u)
+			}
+			if !rule.pattern.MatchString(u) {
+				continue
+			}
+			newURL, err := url.Parse(rule.pattern.ReplaceAllString(u, rule.Value))
+			if err != nil {
+				return applied, fmt.Errorf("правило %q сформировало некорректный URL: %s", rule.title(), err)
+			}
+			req.URL = newURL
+			req.Host = newURL.Host
+			changed = true
+		case entity.RuleActionReplaceBody:
+			body, err := replaceBody(&req.Body, rule.pattern, rule.Value)
+			if err != nil {
+				return applied, err
+			}
+			if body < 0 {
+				continue
+			}
+			req.ContentLength = int64(body)
+			req.TransferEncoding = nil
+			changed = true
+		default:
+			changed = rewriteHeader(req.Header, rule)
+		}
+		if changed {
+			applied = append(applied, rule.title())
+		}
+	}
+	return applied, nil
+}
+
+func (r *Rewrite) ApplyResponse(req *http.Request, res *http.Response) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	applied := make([]string, 0)
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(req, entity.RuleDirectionResponse) {
+			continue
+		}
+
+		var changed bool
+		switch rule.Action {
+		case entity.RuleActionSetStatus:
+			code, _ := strconv.Atoi(rule.Value)
+			res.StatusCode = code
+			res.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+			changed = true
+		case entity.RuleActionReplaceBody:
+			body, err := replaceBody(&res.Body, rule.pattern, rule.Value)
+			if err != nil {
+				return applied, err
+			}
+			if body < 0 {
+				continue
+			}
+			res.ContentLength = int64(body)
+			res.TransferEncoding = nil
+			res.Header.Set("Content-Length", strconv.Itoa(body))
+			changed = true
+		default:
+			changed = rewriteHeader(res.Header, rule)
+		}
+		if changed {
+			applied = append(applied, rule.title())
+		}
+	}
+	return applied, nil
+}
+
+func rewriteHeader(header http.Header, rule *compiledRule) bool {
+	switch rule.Action {
+	case entity.RuleActionAddHeader:
+		header.Add(rule.Header, rule.Value)
+		return true
+	case entity.RuleActionRemoveHeader:
+		if header.Values(rule.Header) == nil {
+			return false
+		}
+		header.Del(rule.Header)
+		return true
+	case entity.RuleActionReplaceHeader:
+		if rule.pattern == nil {
+			header.Set(rule.Header, rule.Value)
+			return true
+		}
+		values := header.Values(rule.Header)
+		changed := false
+		for i, value := range values {
+			if rule.pattern.MatchString(value) {
+				values[i] = rule.pattern.ReplaceAllString(value, rule.Value)
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// replaceBody заменяет pattern в теле и возвращает новую длину тела или -1, если замен не было
+func replaceBody(body *io.ReadCloser, pattern *regexp.Regexp, value string) (int, error) {
+	if *body == nil {
+		return -1, nil
+	}
+	buf, err := io.ReadAll(*body)
+	if err != nil {
+		return -1, fmt.Errorf("ошибка чтения тела: %s", err)
+	}
+	(*body).Close()
+
+	if !pattern.Match(buf) {
+		*body = io.NopCloser(strings.NewReader(string(buf)))
+		return -1, nil
+	}
+	replaced := pattern.ReplaceAllString(string(buf), value)
+	*body = io.NopCloser(strings.NewReader(replaced))
+	return len(replaced), nil
+}
+
+func (r *Rewrite) Rules() []entity.RewriteRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rules := make([]entity.RewriteRule, len(r.rules))
+	for i, rule := range r.rules {
+		rules[i] = rule.RewriteRule
+	}
+	return rules
+}
+
+func (r *Rewrite) AddRule(rule entity.RewriteRule) error {
+	rule.ID = strings.ToLower(randomString(8))
+	compiled, err := compileRule(rule)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = append(r.rules, compiled)
+	return r.save()
+}
+
+func (r *Rewrite) DeleteRule(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, rule := range r.rules {
+		if rule.ID == id {
+			r.rules = append(r.rules[:i], r.rules[i+1:]...)
+			return r.save()
+		}
+	}
+	return fmt.Errorf("правило %s не найдено", id)
+}
+
+func (r *Rewrite) ToggleRule(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.rules {
+		if r.rules[i].ID == id {
+			r.rules[i].Enabled = !r.rules[i].Enabled
+			return r.save()
+		}
+	}
+	return fmt.Errorf("правило %s не найдено", id)
+}
+
+// save записывает правила обратно в файл, чтобы изменения из веб-интерфейса пережили перезапуск.
+// Без файла изменения действуют до перезапуска или перезагрузки конфигурации
+func (r *Rewrite) save() error {
+	if r.filename == "" {
+		return nil
+	}
+	rules := make([]entity.RewriteRule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		if !rule.fromConfig {
+			rules = append(rules, rule.RewriteRule)
+		}
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(r.filename, data, 0644)
+	if err != nil {
+		return fmt.Errorf("ошибка записи файла правил: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    entity.RewriteRule
+		url     string
+		body    string
+		applied bool
+		// ожидаемые URL, заголовок X-Test и тело после применения правила
+		wantURL    string
+		wantHeader string
+		wantBody   string
+	}{
+		{
+			name:       "добавление заголовка",
+			rule:       entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionAddHeader, Header: "X-Test", Value: "1"},
+			url:        "http://example.com/a",
+			applied:    true,
+			wantURL:    "http://example.com/a",
+			wantHeader: "1",
+		},
+		{
+			name:    "удаление заголовка, которого нет, не считается срабатыванием",
+			rule:    entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionRemoveHeader, Header: "X-Missing"},
+			url:     "http://example.com/a",
+			wantURL: "http://example.com/a",
+		},
+		{
+			name:    "замена в URL",
+			rule:    entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionReplaceURL, Pattern: `/v1/`, Value: "/v2/"},
+			url:     "http://example.com/v1/users",
+			applied: true,
+			wantURL: "http://example.com/v2/users",
+		},
+		{
+			name:     "замена в теле",
+			rule:     entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionReplaceBody, Pattern: `role=user`, Value: "role=admin"},
+			url:      "http://example.com/profile",
+			body:     "name=a&role=user",
+			applied:  true,
+			wantURL:  "http://example.com/profile",
+			wantBody: "name=a&role=admin",
+		},
+		{
+			name:    "другой хост",
+			rule:    entity.RewriteRule{Direction: entity.RuleDirectionRequest, Host: "*.example.org", Action: entity.RuleActionAddHeader, Header: "X-Test", Value: "1"},
+			url:     "http://example.com/a",
+			wantURL: "http://example.com/a",
+		},
+		{
+			name:    "другой путь",
+			rule:    entity.RewriteRule{Direction: entity.RuleDirectionRequest, Path: "^/api", Action: entity.RuleActionAddHeader, Header: "X-Test", Value: "1"},
+			url:     "http://example.com/a",
+			wantURL: "http://example.com/a",
+		},
+		{
+			name:    "правило для ответа",
+			rule:    entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionAddHeader, Header: "X-Test", Value: "1"},
+			url:     "http://example.com/a",
+			wantURL: "http://example.com/a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Enabled = true
+			uc, err := NewRewriteUsecase([]entity.RewriteRule{tt.rule}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+			applied, err := uc.ApplyRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(applied) > 0) != tt.applied {
+				t.Errorf("сработавшие правила %v, ожидалось срабатывание: %t", applied, tt.applied)
+			}
+			if req.URL.String() != tt.wantURL {
+				t.Errorf("URL %q, ожидался %q", req.URL, tt.wantURL)
+			}
+			if got := req.Header.Get("X-Test"); got != tt.wantHeader {
+				t.Errorf("X-Test = %q, ожидалось %q", got, tt.wantHeader)
+			}
+			body, _ := io.ReadAll(req.Body)
+			want := tt.wantBody
+			if want == "" {
+				want = tt.body
+			}
+			if string(body) != want {
+				t.Errorf("тело %q, ожидалось %q", body, want)
+			}
+			if tt.wantBody != "" && req.ContentLength != int64(len(tt.wantBody)) {
+				t.Errorf("ContentLength = %d, ожидалось %d", req.ContentLength, len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       entity.RewriteRule
+		wantStatus int
+		wantHeader string
+		wantBody   string
+	}{
+		{
+			name:       "код ответа",
+			rule:       entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionSetStatus, Value: "418"},
+			wantStatus: http.StatusTeapot,
+			wantHeader: "no-store",
+			wantBody:   "admin=false",
+		},
+		{
+			name:       "перезапись заголовка целиком",
+			rule:       entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionReplaceHeader, Header: "Cache-Control", Value: "max-age=60"},
+			wantStatus: http.StatusOK,
+			wantHeader: "max-age=60",
+			wantBody:   "admin=false",
+		},
+		{
+			name:       "замена по выражению в заголовке",
+			rule:       entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionReplaceHeader, Header: "Cache-Control", Pattern: "no-", Value: "must-"},
+			wantStatus: http.StatusOK,
+			wantHeader: "must-store",
+			wantBody:   "admin=false",
+		},
+		{
+			name:       "замена в теле",
+			rule:       entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionReplaceBody, Pattern: "false", Value: "true"},
+			wantStatus: http.StatusOK,
+			wantHeader: "no-store",
+			wantBody:   "admin=true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Enabled = true
+			uc, err := NewRewriteUsecase([]entity.RewriteRule{tt.rule}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Cache-Control": {"no-store"}},
+				Body:       io.NopCloser(strings.NewReader("admin=false")),
+			}
+			applied, err := uc.ApplyResponse(req, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != 1 {
+				t.Errorf("сработавшие правила %v, ожидалось одно", applied)
+			}
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("код ответа %d, ожидался %d", res.StatusCode, tt.wantStatus)
+			}
+			if got := res.Header.Get("Cache-Control"); got != tt.wantHeader {
+				t.Errorf("Cache-Control = %q, ожидалось %q", got, tt.wantHeader)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("тело %q, ожидалось %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRewriteRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule entity.RewriteRule
+	}{
+		{"неизвестное направление", entity.RewriteRule{Direction: "both", Action: entity.RuleActionRemoveHeader, Header: "X"}},
+		{"заголовок не указан", entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionAddHeader}},
+		{"URL в ответе", entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionReplaceURL, Pattern: "a"}},
+		{"код ответа в запросе", entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionSetStatus, Value: "200"}},
+		{"некорректный код ответа", entity.RewriteRule{Direction: entity.RuleDirectionResponse, Action: entity.RuleActionSetStatus, Value: "42"}},
+		{"замена в теле без выражения", entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionReplaceBody}},
+		{"некорректное выражение", entity.RewriteRule{Direction: entity.RuleDirectionRequest, Action: entity.RuleActionReplaceBody, Pattern: "("}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); err == nil {
+				t.Error("ожидалась ошибка")
+			}
+		})
+	}
+}
+
+func TestRewriteConfigRulesNotSaved(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	config := entity.RewriteRule{Name: "из конфигурации", Enabled: true, Direction: entity.RuleDirectionRequest, Action: entity.RuleActionRemoveHeader, Header: "X-A"}
+	uc, err := NewRewriteUsecase([]entity.RewriteRule{config}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uc.AddRule(entity.RewriteRule{Name: "из веб-интерфейса", Enabled: true, Direction: entity.RuleDirectionRequest, Action: entity.RuleActionRemoveHeader, Header: "X-B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), config.Name) || !strings.Contains(string(data), "из веб-интерфейса") {
+		t.Errorf("в файл должны попадать только правила из веб-интерфейса: %s", data)
+	}
+
+	// при перезагрузке правила из конфигурации не задваиваются
+	err = uc.Reload([]entity.RewriteRule{config}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, rule := range uc.Rules() {
+		names = append(names, rule.Name)
+	}
+	if !slices.Equal(names, []string{"из конфигурации", "из веб-интерфейса"}) {
+		t.Errorf("правила после перезагрузки: %v", names)
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/repository"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"net/url"
+	"time"
+)
+
+type Scanner struct {
+	HistoryRepository repository.History
+	FindingRepository repository.Finding
+	scopeUsecase      usecase.ScopeUsecase
+	upstreamUsecase   usecase.UpstreamUsecase
+	liveUsecase       usecase.LiveUsecase
+	historyUsecase    usecase.HistoryUsecase
+	passiveChecks     []passiveCheck
+}
+
+func NewScannerUsecase(historyRepo repository.History, findingRepo repository.Finding, scopeUC usecase.ScopeUsecase, upstreamUC usecase.UpstreamUsecase, liveUC usecase.LiveUsecase) usecase.ScannerUsecase {
+	return &Scanner{
+		HistoryRepository: historyRepo,
+		FindingRepository: findingRepo,
+		scopeUsecase:      scopeUC,
+		upstreamUsecase:   upstreamUC,
+		liveUsecase:       liveUC,
+		passiveChecks:     defaultPassiveChecks(),
+	}
+}
+
+func (s *Scanner) SetHistoryUsecase(historyUC usecase.HistoryUsecase) {
+	s.historyUsecase = historyUC
+}
+
+func (s *Scanner) PassiveScan(id string) ([]entity.Finding, error) {
+	obj, err := s.HistoryRepository.GetHistoryObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(obj.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	findings := make([]entity.Finding, 0)
+	for _, check := range s.passiveChecks {
+		for _, f := range check(obj) {
+			// общие для всех проверок поля заполняем здесь, чтобы не дублировать их в каждой проверке
+			f.HistoryID = id
+			f.Host = u.Host
+			f.Path = u.Path
+			f.EvidenceIDs = []string{id}
+			f.Status = entity.FindingStatusOpen
+			f.DateTime = time.Now().Format(time.RFC3339)
+			findings = append(findings, f)
+		}
+	}
+
+	err = s.FindingRepository.AddFindings(findings)
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func (s *Scanner) HistoryFindings(id string) ([]entity.Finding, error) {
+	return s.FindingRepository.GetFindingsByHistoryID(id)
+}
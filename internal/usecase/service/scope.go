@@ -0,0 +1,162 @@
+package service
+
+import (
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type compiledScopeRule struct {
+	entity.ScopeRule
+	path *regexp.Regexp
+}
+
+type Scope struct {
+	mu      sync.RWMutex
+	include []compiledScopeRule
+	exclude []compiledScopeRule
+}
+
+func NewScopeUsecase(scope entity.Scope, filename string) (usecase.ScopeUsecase, error) {
+	s := &Scope{}
+	err := s.Reload(scope, filename)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload заменяет правила scope. Если правила или файл некорректны, остаются прежние правила
+func (s *Scope) Reload(scope entity.Scope, filename string) error {
+	// без правил в scope входит весь трафик
+	var file entity.Scope
+	err := readJSONFile(filename, &file)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки файла scope: %s", err)
+	}
+	include, err := compileScopeRules(append(slices.Clone(scope.Include), file.Include...))
+	if err != nil {
+		return err
+	}
+	exclude, err := compileScopeRules(append(slices.Clone(scope.Exclude), file.Exclude...))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.include, s.exclude = include, exclude
+	return nil
+}
+
+func compileScopeRules(rules []entity.ScopeRule) ([]compiledScopeRule, error) {
+	compiled := make([]compiledScopeRule, len(rules))
+	for i, rule := range rules {
+		err := rule.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("правило scope: %s", err)
+		}
+		compiled[i].ScopeRule = rule
+		if rule.Path != "" {
+			compiled[i].path = regexp.MustCompile(rule.Path)
+		}
+	}
+	return compiled, nil
+}
+
+// matchHost сверяет схему, хост и порт, не глядя на путь
+func (r *compiledScopeRule) matchHost(scheme, host, port string) bool {
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, scheme) {
+		return false
+	}
+	if r.Port != "" && r.Port != port {
+		return false
+	}
+	return entity.MatchHostPattern(r.Host, host)
+}
+
+func (s *Scope) InScope(u *url.URL) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scheme, host, port := splitURL(u)
+	included := len(s.include) == 0
+	for i := range s.include {
+		rule := &s.include[i]
+		if rule.matchHost(scheme, host, port) && (rule.path == nil || rule.path.MatchString(u.Path)) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for i := range s.exclude {
+		rule := &s.exclude[i]
+		if rule.matchHost(scheme, host, port) && (rule.path == nil || rule.path.MatchString(u.Path)) {
+			return false
+		}
+	}
+	return true
+}
+
+// InScopeHost решает, может ли на хост идти трафик из scope, когда путь ещё неизвестен (например, при CONNECT).
+// Исключающие правила с путём здесь не учитываются - они применятся к отдельным запросам внутри туннеля
+func (s *Scope) InScopeHost(scheme, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, defaultPort(scheme)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	included := len(s.include) == 0
+	for i := range s.include {
+		if s.include[i].matchHost(scheme, host, port) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for i := range s.exclude {
+		rule := &s.exclude[i]
+		if rule.path == nil && rule.matchHost(scheme, host, port) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scope) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !s.InScope(u) {
+		return fmt.Errorf("%w: %s", usecase.ErrOutOfScope, rawURL)
+	}
+	return nil
+}
+
+func splitURL(u *url.URL) (string, string, string) {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+	return scheme, u.Hostname(), port
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net/url"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	scope := entity.Scope{
+		Include: []entity.ScopeRule{
+			{Scheme: "https", Host: "*.example.com"},
+			{Host: "api.test", Port: "8080"},
+		},
+		Exclude: []entity.ScopeRule{
+			{Host: "static.example.com"},
+			{Path: "^/logout"},
+		},
+	}
+	tests := []struct {
+		name string
+		// правила scope, nil - правила из scope выше
+		scope *entity.Scope
+		url   string
+		want  bool
+		// ожидаемый ответ InScopeHost для схемы и хоста url
+		wantHost bool
+	}{
+		{
+			name:     "поддомен по шаблону",
+			url:      "https://www.example.com/a",
+			want:     true,
+			wantHost: true,
+		},
+		{
+			name: "шаблон поддоменов не включает сам домен",
+			url:  "https://example.com/",
+		},
+		{
+			name: "другая схема",
+			url:  "http://www.example.com/a",
+		},
+		{
+			name: "порт по умолчанию не совпадает",
+			url:  "http://api.test/",
+		},
+		{
+			name:     "явный порт",
+			url:      "http://api.test:8080/v1",
+			want:     true,
+			wantHost: true,
+		},
+		{
+			name: "исключённый хост",
+			url:  "https://static.example.com/app.js",
+		},
+		{
+			// путь при CONNECT неизвестен, поэтому хост остаётся в scope
+			name:     "исключённый путь",
+			url:      "https://www.example.com/logout",
+			wantHost: true,
+		},
+		{
+			name: "хост не из scope",
+			url:  "https://example.org/",
+		},
+		{
+			name:     "без правил в scope весь трафик",
+			scope:    &entity.Scope{},
+			url:      "http://anything.test/",
+			want:     true,
+			wantHost: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := scope
+			if tt.scope != nil {
+				rules = *tt.scope
+			}
+			uc, err := NewScopeUsecase(rules, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := uc.InScope(u); got != tt.want {
+				t.Errorf("InScope = %t, ожидалось %t", got, tt.want)
+			}
+			if got := uc.InScopeHost(u.Scheme, u.Host); got != tt.wantHost {
+				t.Errorf("InScopeHost = %t, ожидалось %t", got, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestScopeReloadKeepsRulesOnError(t *testing.T) {
+	uc, err := NewScopeUsecase(entity.Scope{Include: []entity.ScopeRule{{Host: "example.com"}}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uc.Reload(entity.Scope{Include: []entity.ScopeRule{{Host: "example.org", Path: "("}}}, "")
+	if err == nil {
+		t.Fatal("некорректное выражение для пути должно давать ошибку")
+	}
+	if !uc.InScopeHost("https", "example.com:443") || uc.InScopeHost("https", "example.org:443") {
+		t.Error("после неудачной перезагрузки должны остаться прежние правила")
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bufferedConn - соединение, часть данных которого уже вычитана из сокета: чтение идёт через reader
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// connContext возвращает контекст соединения, если слушатель его предоставляет: он отменяется,
+// когда соединение закрывается принудительно, и вместе с ним прерывается обмен с сервером
+func connContext(conn net.Conn) context.Context {
+	for {
+		if c, ok := conn.(interface{ Context() context.Context }); ok {
+			return c.Context()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return context.Background()
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// tlsRecordHandshake - тип TLS-записи, с которой начинается ClientHello
+const tlsRecordHandshake = 0x16
+
+var errHelloRead = errors.New("ClientHello прочитан")
+
+// readClientHello вычитывает из потока ClientHello и возвращает его вместе с прочитанными байтами,
+// которые нужно вернуть в поток перед настоящим рукопожатием
+func readClientHello(reader io.Reader) (*tls.ClientHelloInfo, []byte, error) {
+	var raw bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(reader, &raw)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, raw.Bytes(), err
+	}
+	return hello, raw.Bytes(), nil
+}
+
+// readOnlyConn позволяет разобрать ClientHello средствами crypto/tls, ничего не отправляя клиенту
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)       { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+var httpMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS", "TRACE", "CONNECT"}
+
+// maxMethodLen - длина самого длинного метода из httpMethods
+var maxMethodLen = len(slices.MaxFunc(httpMethods, func(a, b string) int { return len(a) - len(b) }))
+
+// looksLikeHTTP проверяет, начинается ли поток со строки HTTP-запроса. Начало запроса может прийти
+// несколькими сегментами, поэтому байты дочитываются до пробела после метода, но не дольше timeout
+// и не дальше, чем становится ясно, что это не HTTP
+func looksLikeHTTP(conn net.Conn, reader *bufio.Reader, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(entity.Deadline(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for n := 1; n <= maxMethodLen+1; n++ {
+		data, err := reader.Peek(n)
+		if err != nil {
+			return false
+		}
+		prefix := false
+		for _, method := range httpMethods {
+			line := method + " "
+			if string(data) == line {
+				return true
+			}
+			prefix = prefix || strings.HasPrefix(line, string(data))
+		}
+		if !prefix {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLooksLikeHTTP(t *testing.T) {
+	tests := []struct {
+		name string
+		// сегменты, которые клиент отправляет с паузой между ними
+		parts []string
+		want  bool
+	}{
+		{
+			name:  "строка запроса целиком",
+			parts: []string{"GET / HTTP/1.1\r\n"},
+			want:  true,
+		},
+		{
+			name:  "метод пришёл несколькими сегментами",
+			parts: []string{"G", "ET", " /", " HTTP/1.1\r\n"},
+			want:  true,
+		},
+		{
+			name:  "самый длинный метод",
+			parts: []string{"OPTIONS", " * HTTP/1.1\r\n"},
+			want:  true,
+		},
+		{
+			name:  "другой протокол",
+			parts: []string{"SSH-2.0-OpenSSH\r\n"},
+		},
+		{
+			// клиент ждёт ответа сервера, поэтому решение принимается без ожидания остальных байтов
+			name:  "короткое приветствие другого протокола",
+			parts: []string{"\x00\x01"},
+		},
+		{
+			name:  "метод без пробела",
+			parts: []string{"GETS / HTTP/1.1\r\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go func() {
+				for _, part := range tt.parts {
+					_, err := io.WriteString(client, part)
+					if err != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			start := time.Now()
+			got := looksLikeHTTP(server, bufio.NewReader(server), time.Second)
+			if got != tt.want {
+				t.Errorf("looksLikeHTTP = %t, ожидалось %t", got, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("решение принято через %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// константы протокола SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socksVersion        = 5
+	socksAuthVersion    = 1
+	socksMethodNoAuth   = 0
+	socksMethodPassword = 2
+	socksNoAcceptable   = 0xff
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksSucceeded      = 0
+	socksAuthFailed     = 1
+	socksCmdUnsupported = 7
+)
+
+// socksConnect выполняет рукопожатие SOCKS5 на уже установленном соединении с прокси и просит подключиться к addr
+func socksConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	methods := []byte{socksMethodNoAuth}
+	if user != nil {
+		methods = append(methods, socksMethodPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("неподдерживаемая версия SOCKS: %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksMethodNoAuth:
+	case socksMethodPassword:
+		if user == nil {
+			return errors.New("SOCKS-прокси требует аутентификацию")
+		}
+		password, _ := user.Password()
+		msg := []byte{socksAuthVersion, byte(len(user.Username()))}
+		msg = append(msg, user.Username()...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		_, err = conn.Write(msg)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != socksSucceeded {
+			return errors.New("SOCKS-прокси отверг логин или пароль")
+		}
+	default:
+		return errors.New("SOCKS-прокси не поддерживает ни один из предложенных методов аутентификации")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	msg := []byte{socksVersion, socksCmdConnect, 0}
+	msg = appendSocksAddr(msg, host, port)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 3)
+	_, err = io.ReadFull(conn, head)
+	if err != nil {
+		return err
+	}
+	if head[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS-прокси не смог подключиться к %s: код %d", addr, head[1])
+	}
+	// адрес, к которому привязался прокси, не нужен, но его надо вычитать
+	_, err = readSocksAddr(conn)
+	return err
+}
+
+func appendSocksAddr(msg []byte, host, port string) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = append(msg, socksAddrIPv4)
+			msg = append(msg, ip4...)
+		} else {
+			msg = append(msg, socksAddrIPv6)
+			msg = append(msg, ip.To16()...)
+		}
+	} else {
+		msg = append(msg, socksAddrDomain, byte(len(host)))
+		msg = append(msg, host...)
+	}
+	p, _ := strconv.Atoi(port)
+	return binary.BigEndian.AppendUint16(msg, uint16(p))
+}
+
+// readSocksAddr читает адрес в формате SOCKS5 (тип, адрес, порт) и возвращает его в виде host:port
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(r, size)
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		_, err = io.ReadFull(r, domain)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("неизвестный тип адреса SOCKS: %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// HandleSocksConn выполняет рукопожатие SOCKS5 с клиентом и передаёт полученный поток в HandleStream
+func (p Proxy) HandleSocksConn(conn net.Conn) error {
+	defer conn.Close()
+	// рукопожатие SOCKS ограничено тем же таймаутом, что и чтение заголовков HTTP-запроса
+	_ = conn.SetDeadline(entity.Deadline(p.timeouts.ReadHeader))
+
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения приветствия SOCKS: %s", err)
+	}
+	if head[0] != socksVersion {
+		return fmt.Errorf("неподдерживаемая версия SOCKS: %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения приветствия SOCKS: %s", err)
+	}
+
+	method := byte(socksMethodNoAuth)
+	if p.socksUser != nil {
+		method = socksMethodPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("клиент SOCKS не поддерживает требуемый метод аутентификации")
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return err
+	}
+	if method == socksMethodPassword {
+		err = p.socksAuthenticate(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	request := make([]byte, 3)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения запроса SOCKS: %s", err)
+	}
+	addr, err := readSocksAddr(conn)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения запроса SOCKS: %s", err)
+	}
+	if request[1] != socksCmdConnect {
+		_, _ = conn.Write([]byte{socksVersion, socksCmdUnsupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return fmt.Errorf("неподдерживаемая команда SOCKS: %d", request[1])
+	}
+
+	// адрес, к которому привязан прокси, клиенту не нужен - отвечаем нулевым
+	_, err = conn.Write([]byte{socksVersion, socksSucceeded, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return err
+	}
+	// таймаут рукопожатия снимается целиком, включая запись: дальше таймауты задаёт обработка потока
+	_ = conn.SetDeadline(time.Time{})
+	ctx := connContext(conn)
+	if p.socksUser != nil {
+		ctx = withProxyUser(ctx, p.socksUser.Username())
+	}
+	return p.handleStream(ctx, conn, addr)
+}
+
+// socksAuthenticate проверяет логин и пароль клиента (RFC 1929)
+func (p Proxy) socksAuthenticate(conn net.Conn) error {
+	credentials := make([][]byte, 2)
+	head := make([]byte, 1)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения аутентификации SOCKS: %s", err)
+	}
+	for i := range credentials {
+		_, err = io.ReadFull(conn, head)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения аутентификации SOCKS: %s", err)
+		}
+		credentials[i] = make([]byte, head[0])
+		_, err = io.ReadFull(conn, credentials[i])
+		if err != nil {
+			return fmt.Errorf("ошибка чтения аутентификации SOCKS: %s", err)
+		}
+	}
+
+	password, _ := p.socksUser.Password()
+	userOK := subtle.ConstantTimeCompare(credentials[0], []byte(p.socksUser.Username())) == 1
+	passwordOK := subtle.ConstantTimeCompare(credentials[1], []byte(password)) == 1
+	if !userOK || !passwordOK {
+		_, _ = conn.Write([]byte{socksAuthVersion, socksAuthFailed})
+		return fmt.Errorf("неверный логин или пароль SOCKS: %s", credentials[0])
+	}
+	_, err = conn.Write([]byte{socksAuthVersion, socksSucceeded})
+	return err
+}
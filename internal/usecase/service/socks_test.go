@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	tests := []struct {
+		name string
+		// учётные данные, которые требует прокси и которые передаёт клиент
+		server  *url.Userinfo
+		client  *url.Userinfo
+		wantErr bool
+	}{
+		{
+			name: "без аутентификации",
+		},
+		{
+			name:   "клиент с паролем, прокси без аутентификации",
+			client: url.UserPassword("user", "secret"),
+		},
+		{
+			name:   "логин и пароль",
+			server: url.UserPassword("user", "secret"),
+			client: url.UserPassword("user", "secret"),
+		},
+		{
+			name:    "неверный пароль",
+			server:  url.UserPassword("user", "secret"),
+			client:  url.UserPassword("user", "wrong"),
+			wantErr: true,
+		},
+		{
+			name:    "клиент без пароля",
+			server:  url.UserPassword("user", "secret"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			done := make(chan error, 1)
+			go func() {
+				done <- Proxy{socksUser: tt.server}.HandleSocksConn(server)
+			}()
+
+			err := socksConnect(client, "example.com:443", tt.client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка рукопожатия %v, ожидалась ошибка: %t", err, tt.wantErr)
+			}
+			_ = client.Close()
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("ошибка прокси %v, ожидалась ошибка: %t", err, tt.wantErr)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("прокси не завершил обработку соединения")
+			}
+		})
+	}
+}
+
+func TestSocksAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		port string
+		// ожидаемый тип адреса в сообщении
+		atyp byte
+		want string
+	}{
+		{"IPv4", "192.0.2.1", "80", socksAddrIPv4, "192.0.2.1:80"},
+		{"IPv6", "2001:db8::1", "443", socksAddrIPv6, "[2001:db8::1]:443"},
+		{"доменное имя", "example.com", "8080", socksAddrDomain, "example.com:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := appendSocksAddr(nil, tt.host, tt.port)
+			if msg[0] != tt.atyp {
+				t.Errorf("тип адреса %d, ожидался %d", msg[0], tt.atyp)
+			}
+			got, err := readSocksAddr(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("прочитан адрес %q, ожидался %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bufferWindow - сколько ждать окончания тела без длины (chunked или до закрытия соединения), прежде чем
+// считать ответ потоковым. Так длинные опросы и бесконечные потоки (NDJSON, multipart/x-mixed-replace) не задерживают клиента
+const bufferWindow = 2 * time.Second
+
+// maxBufferedBody - тело больше этого размера не буферизуется целиком, а пересылается клиенту по мере получения
+const maxBufferedBody = maxWireCapture
+
+// prefetchChunk - размер части тела, которую фоновое чтение передаёт за раз
+const prefetchChunk = 32 << 10
+
+// bufferResponse дочитывает тело ответа целиком, чтобы к нему применились правила и перехват ответа.
+// Тело с Content-Length до limit читается без ограничения по времени. Тело без длины или длиннее limit читается
+// не дольше window и не больше limit: если за это время оно не закончилось, ответ потоковый, прочитанное остаётся
+// в начале тела, а остальное клиент получит по мере поступления. Возвращает true, если тело прочитано целиком
+func bufferResponse(res *http.Response, window time.Duration, limit int) (bool, error) {
+	if res.Body == nil || res.Body == http.NoBody {
+		return true, nil
+	}
+	if res.ContentLength >= 0 && res.ContentLength <= int64(limit) {
+		_, err := peekBody(&res.Body)
+		return err == nil, err
+	}
+
+	body := newPrefetchBody(res.Body)
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(body.prefix) <= limit {
+		select {
+		case chunk, ok := <-body.chunks:
+			if !ok {
+				if !errors.Is(body.err, io.EOF) {
+					return false, body.err
+				}
+				res.Body = io.NopCloser(bytes.NewReader(body.prefix))
+				return true, nil
+			}
+			body.prefix = append(body.prefix, chunk...)
+		case <-timer.C:
+			res.Body = body
+			return false, nil
+		}
+	}
+	res.Body = body
+	return false, nil
+}
+
+// prefetchBody читает тело в отдельной горутине, чтобы ожидание следующей части можно было прервать по таймеру:
+// ошибка таймаута при чтении chunked-тела через net/http необратима, поэтому дедлайн соединения здесь не подходит
+type prefetchBody struct {
+	src    io.ReadCloser
+	chunks chan []byte
+	// ошибка чтения, её можно читать после закрытия chunks
+	err error
+	// прочитанное, но ещё не отданное
+	prefix []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newPrefetchBody(src io.ReadCloser) *prefetchBody {
+	b := &prefetchBody{src: src, chunks: make(chan []byte), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+func (b *prefetchBody) run() {
+	defer close(b.chunks)
+	// тело закрывает горутина, которая его читает: Close у тела net/http ждёт окончания идущего Read
+	defer b.src.Close()
+	for {
+		buf := make([]byte, prefetchChunk)
+		n, err := b.src.Read(buf)
+		if n > 0 {
+			select {
+			case b.chunks <- buf[:n]:
+			case <-b.done:
+				b.err = net.ErrClosed
+				return
+			}
+		}
+		if err != nil {
+			b.err = err
+			return
+		}
+	}
+}
+
+func (b *prefetchBody) Read(p []byte) (int, error) {
+	if len(b.prefix) == 0 {
+		chunk, ok := <-b.chunks
+		if !ok {
+			return 0, b.err
+		}
+		b.prefix = chunk
+	}
+	n := copy(p, b.prefix)
+	b.prefix = b.prefix[n:]
+	return n, nil
+}
+
+// Close останавливает фоновое чтение. Само соединение с сервером закрывает тот, кто его открыл
+func (b *prefetchBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return nil
+}
+
+// relayStream пересылает клиенту потоковый ответ по мере получения и сохраняет его части в историю как события:
+// для Server-Sent Events - разобранные события, для остальных потоков - части тела в том виде, в котором они пришли.
+// Тело потока не заканчивается, поэтому правила перезаписи и перехват ответа к нему не применяются
+func (p Proxy) relayStream(conn net.Conn, req *http.Request, res *http.Response, meta entity.HistoryMeta) (bool, error) {
+	id, err := p.historyUsecase.AddStream(req, res, meta)
+	var recorder *streamRecorder
+	if err != nil {
+		// без записи в истории событиям некуда сохраняться, но клиент всё равно должен получить поток
+		slog.ErrorContext(req.Context(), "Ошибка сохранения истории запроса", "error", err)
+	} else {
+		recorder = newStreamRecorder(func(events []entity.StreamEvent) error {
+			return p.historyUsecase.AppendStreamEvents(id, events)
+		})
+		var parser streamParser = &chunkParser{}
+		if entity.IsEventStream(res) {
+			parser = &eventParser{}
+		}
+		res.Body = &eventTap{ReadCloser: res.Body, parser: parser, onEvents: recorder.add}
+	}
+
+	writeErr := p.writeResponse(conn, res)
+	if recorder != nil {
+		if dropped := recorder.close(); dropped > 0 {
+			slog.WarnContext(req.Context(), "Хранилище не успевало за потоком, часть событий не сохранена", "history_id", id, "dropped", dropped)
+		}
+		if err := p.historyUsecase.CloseStream(id, writeErr); err != nil {
+			slog.ErrorContext(req.Context(), "Ошибка сохранения истории запроса", "error", err)
+		}
+	}
+	if writeErr != nil {
+		return false, fmt.Errorf("ошибка отправки потока клиенту: %s", writeErr)
+	}
+	return keepAlive(req, res), nil
+}
+
+const (
+	// streamBatchSize - число событий, после которого пачка сохраняется, не дожидаясь streamFlushInterval
+	streamBatchSize = 100
+	// streamFlushInterval - как часто сохраняются накопившиеся события
+	streamFlushInterval = 500 * time.Millisecond
+	// maxPendingEvents ограничивает очередь несохранённых событий, если хранилище не успевает за потоком
+	maxPendingEvents = 10000
+)
+
+// streamRecorder сохраняет события потока пачками в отдельной горутине:
+// запись в хранилище не должна задерживать пересылку потока клиенту
+type streamRecorder struct {
+	save    func([]entity.StreamEvent) error
+	mu      sync.Mutex
+	pending []entity.StreamEvent
+	dropped int
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newStreamRecorder(save func([]entity.StreamEvent) error) *streamRecorder {
+	r := &streamRecorder{
+		save:    save,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// add ставит события в очередь на сохранение. Если очередь переполнена, события отбрасываются
+func (r *streamRecorder) add(events []entity.StreamEvent) {
+	r.mu.Lock()
+	if len(r.pending)+len(events) > maxPendingEvents {
+		r.dropped += len(events)
+	} else {
+		r.pending = append(r.pending, events...)
+	}
+	full := len(r.pending) >= streamBatchSize
+	r.mu.Unlock()
+	if full {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *streamRecorder) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+		case <-r.done:
+			r.flush()
+			return
+		}
+		r.flush()
+	}
+}
+
+func (r *streamRecorder) flush() {
+	r.mu.Lock()
+	events := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	if err := r.save(events); err != nil {
+		slog.Error("Ошибка сохранения событий потока", "events", len(events), "error", err)
+	}
+}
+
+// close сохраняет оставшиеся события и возвращает число событий, отброшенных из-за переполнения очереди
+func (r *streamRecorder) close() int {
+	close(r.done)
+	<-r.stopped
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// writeResponse отправляет ответ клиенту. Таймаут записи продлевается перед каждой частью тела:
+// он ограничивает запись одной части, а не всего ответа, который может передаваться сколько угодно долго
+func (p Proxy) writeResponse(conn net.Conn, res *http.Response) error {
+	_ = conn.SetWriteDeadline(entity.Deadline(p.timeouts.Write))
+	if res.Body != nil && res.Body != http.NoBody {
+		res.Body = &deadlineBody{ReadCloser: res.Body, conn: conn, timeout: p.timeouts.Write}
+	}
+	return res.Write(conn)
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	_ = b.conn.SetWriteDeadline(entity.Deadline(b.timeout))
+	return n, err
+}
+
+// streamParser выделяет события из частей тела потока
+type streamParser interface {
+	// feed принимает очередную часть потока и возвращает события, которые в ней завершились
+	feed(chunk []byte, at time.Time) []entity.StreamEvent
+}
+
+// eventTap разбирает события в теле потока по мере его чтения
+type eventTap struct {
+	io.ReadCloser
+	parser   streamParser
+	onEvents func([]entity.StreamEvent)
+}
+
+func (t *eventTap) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	if events := t.parser.feed(b[:n], time.Now()); len(events) > 0 {
+		t.onEvents(events)
+	}
+	return n, err
+}
+
+// chunkParser сохраняет каждую часть потока без определённого формата как отдельное событие,
+// пока их общий размер не превысит maxWireCapture
+type chunkParser struct {
+	size int
+}
+
+func (p *chunkParser) feed(chunk []byte, at time.Time) []entity.StreamEvent {
+	if len(chunk) == 0 || p.size+len(chunk) > maxWireCapture {
+		return nil
+	}
+	p.size += len(chunk)
+	return []entity.StreamEvent{{Time: at, Data: string(chunk)}}
+}
+
+// eventParser разбирает поток Server-Sent Events: событие состоит из строк "поле: значение" и завершается пустой строкой
+type eventParser struct {
+	line  []byte // начало строки, конец которой ещё не получен
+	event entity.StreamEvent
+	data  []string
+}
+
+func (p *eventParser) feed(chunk []byte, at time.Time) []entity.StreamEvent {
+	var events []entity.StreamEvent
+	for len(chunk) > 0 {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			p.line = append(p.line, chunk...)
+			break
+		}
+		line := append(p.line, chunk[:i]...)
+		p.line = nil
+		chunk = chunk[i+1:]
+		if event, ok := p.parseLine(bytes.TrimSuffix(line, []byte("\r")), at); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (p *eventParser) parseLine(line []byte, at time.Time) (entity.StreamEvent, bool) {
+	if len(line) == 0 {
+		event, data := p.event, p.data
+		p.event, p.data = entity.StreamEvent{}, nil
+		// событие без данных не доставляется клиенту и не сохраняется
+		if data == nil {
+			return event, false
+		}
+		event.Time = at
+		event.Data = strings.Join(data, "\n")
+		return event, true
+	}
+	if line[0] == ':' {
+		// комментарий, обычно служит для поддержания соединения
+		return entity.StreamEvent{}, false
+	}
+	field, value, _ := bytes.Cut(line, []byte(":"))
+	value = bytes.TrimPrefix(value, []byte(" "))
+	switch string(field) {
+	case "event":
+		p.event.Event = string(value)
+	case "id":
+		p.event.ID = string(value)
+	case "data":
+		p.data = append(p.data, string(value))
+	}
+	return entity.StreamEvent{}, false
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufferResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		// части ответа сервера: следующая отправляется, только когда тест прочитал из тела всё, что пришло раньше
+		parts []string
+		// после последней части сервер закрывает соединение
+		closeAfter bool
+		limit      int
+		complete   bool
+		// то, что тело отдаёт сразу после bufferResponse, ещё до отправки следующих частей
+		prefix string
+		body   string
+	}{
+		{
+			name:     "Content-Length",
+			parts:    []string{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"},
+			limit:    1024,
+			complete: true,
+			body:     "hello",
+		},
+		{
+			name:     "chunked заканчивается сразу",
+			parts:    []string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"},
+			limit:    1024,
+			complete: true,
+			body:     "hello",
+		},
+		{
+			name:       "тело до закрытия соединения",
+			parts:      []string{"HTTP/1.1 200 OK\r\n\r\nhello"},
+			closeAfter: true,
+			limit:      1024,
+			complete:   true,
+			body:       "hello",
+		},
+		{
+			name: "длинный опрос держит chunked-тело",
+			parts: []string{
+				"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n1\r\n[\r\n",
+				"7\r\n{\"a\":1}\r\n1\r\n]\r\n0\r\n\r\n",
+			},
+			limit:  1024,
+			prefix: "[",
+			body:   "[{\"a\":1}]",
+		},
+		{
+			name: "NDJSON без длины до закрытия соединения",
+			parts: []string{
+				"HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\n\r\n{\"n\":1}\n",
+				"{\"n\":2}\n",
+			},
+			closeAfter: true,
+			limit:      1024,
+			prefix:     "{\"n\":1}\n",
+			body:       "{\"n\":1}\n{\"n\":2}\n",
+		},
+		{
+			name:     "тело больше ограничения",
+			parts:    []string{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"},
+			limit:    4,
+			complete: false,
+			body:     "hello world",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			next := make(chan struct{})
+			go func() {
+				for i, part := range tt.parts {
+					if i > 0 {
+						<-next
+					}
+					_, _ = io.WriteString(server, part)
+				}
+				if tt.closeAfter {
+					_ = server.Close()
+				}
+			}()
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/poll", nil)
+			res, err := http.ReadResponse(bufio.NewReader(client), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			complete, err := bufferResponse(res, 50*time.Millisecond, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if complete != tt.complete {
+				t.Fatalf("complete = %t, ожидалось %t", complete, tt.complete)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("bufferResponse ждал %s, хотя сервер держит тело", elapsed)
+			}
+
+			got := make([]byte, 0)
+			if tt.prefix != "" {
+				// всё, что сервер уже прислал, клиент получает, не дожидаясь конца тела
+				buf := make([]byte, len(tt.prefix))
+				_, err := io.ReadFull(res.Body, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf) != tt.prefix {
+					t.Errorf("начало тела %q, ожидалось %q", buf, tt.prefix)
+				}
+				got = append(got, buf...)
+			}
+			close(next)
+			rest, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, rest...)
+			if string(got) != tt.body {
+				t.Errorf("тело %q, ожидалось %q", got, tt.body)
+			}
+			_ = res.Body.Close()
+		})
+	}
+}
+
+func TestPrefetchBodyCloseStopsReading(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		_, _ = io.WriteString(server, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+	}()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	res, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete, err := bufferResponse(res, 20*time.Millisecond, 1024)
+	if err != nil || complete {
+		t.Fatalf("ожидался незаконченный ответ, получено complete=%t, err=%v", complete, err)
+	}
+	body := res.Body.(*prefetchBody)
+	_ = res.Body.Close()
+	// соединение с сервером закрывает тот, кто его открыл, после этого фоновое чтение завершается
+	_ = client.Close()
+	select {
+	case _, ok := <-body.chunks:
+		for ok {
+			_, ok = <-body.chunks
+		}
+	case <-time.After(time.Second):
+		t.Fatal("фоновое чтение не остановилось")
+	}
+}
+
+func TestStreamRecorder(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]entity.StreamEvent
+	recorder := newStreamRecorder(func(events []entity.StreamEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, events)
+		return nil
+	})
+	const total = 2*streamBatchSize + 7
+	for i := range total {
+		recorder.add([]entity.StreamEvent{{Data: fmt.Sprint(i)}})
+	}
+	if dropped := recorder.close(); dropped != 0 {
+		t.Fatalf("отброшено %d событий", dropped)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	saved := make([]string, 0, total)
+	for _, batch := range batches {
+		for _, event := range batch {
+			saved = append(saved, event.Data)
+		}
+	}
+	want := make([]string, 0, total)
+	for i := range total {
+		want = append(want, fmt.Sprint(i))
+	}
+	if !slices.Equal(saved, want) {
+		t.Errorf("сохранены события %v, ожидались %v", saved, want)
+	}
+	if len(batches) >= total {
+		t.Errorf("события сохранялись по одному: %d записей на %d событий", len(batches), total)
+	}
+}
+
+func TestStreamRecorderSlowStorage(t *testing.T) {
+	release := make(chan struct{})
+	var saved int
+	recorder := newStreamRecorder(func(events []entity.StreamEvent) error {
+		<-release
+		saved += len(events)
+		return errors.New("хранилище недоступно")
+	})
+
+	// пока хранилище не отвечает, пересылка потока не должна останавливаться
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range maxPendingEvents + 2*streamBatchSize {
+			recorder.add([]entity.StreamEvent{{Data: "x"}})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("add заблокировался на медленном хранилище")
+	}
+	close(release)
+	dropped := recorder.close()
+	if dropped == 0 {
+		t.Error("при переполнении очереди события должны отбрасываться")
+	}
+	if saved+dropped != maxPendingEvents+2*streamBatchSize {
+		t.Errorf("сохранено %d и отброшено %d событий из %d", saved, dropped, maxPendingEvents+2*streamBatchSize)
+	}
+}
+
+func TestChunkParser(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	parser := &chunkParser{}
+	events := parser.feed([]byte("{\"n\":1}\n"), at)
+	if len(events) != 1 || events[0].Data != "{\"n\":1}\n" || !events[0].Time.Equal(at) {
+		t.Fatalf("получены события %+v", events)
+	}
+	if events := parser.feed(nil, at); len(events) != 0 {
+		t.Errorf("пустая часть дала события %+v", events)
+	}
+	if events := parser.feed([]byte(strings.Repeat("x", maxWireCapture)), at); len(events) != 0 {
+		t.Errorf("части сверх ограничения не должны сохраняться")
+	}
+}
+
+func TestEventParser(t *testing.T) {
+	tests := []struct {
+		name string
+		// части тела в том виде, в каком они приходят от сервера
+		chunks []string
+		want   []entity.StreamEvent
+	}{
+		{
+			name:   "одно событие",
+			chunks: []string{"data: hello\n\n"},
+			want:   []entity.StreamEvent{{Data: "hello"}},
+		},
+		{
+			name:   "поля event и id",
+			chunks: []string{"event: update\nid: 42\ndata: {\"a\":1}\n\n"},
+			want:   []entity.StreamEvent{{ID: "42", Event: "update", Data: "{\"a\":1}"}},
+		},
+		{
+			name:   "многострочные данные",
+			chunks: []string{"data: first\ndata: second\n\n"},
+			want:   []entity.StreamEvent{{Data: "first\nsecond"}},
+		},
+		{
+			name:   "событие разрезано между частями",
+			chunks: []string{"da", "ta: hel", "lo\n", "\n"},
+			want:   []entity.StreamEvent{{Data: "hello"}},
+		},
+		{
+			name:   "CRLF",
+			chunks: []string{"data: a\r\n\r\ndata: b\r\n\r\n"},
+			want:   []entity.StreamEvent{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "комментарии и события без данных пропускаются",
+			chunks: []string{": ping\n\nevent: empty\n\ndata:x\n\n"},
+			want:   []entity.StreamEvent{{Data: "x"}},
+		},
+		{
+			name:   "незаконченное событие не отдаётся",
+			chunks: []string{"data: partial\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			parser := &eventParser{}
+			var got []entity.StreamEvent
+			for _, chunk := range tt.chunks {
+				got = append(got, parser.feed([]byte(chunk), at)...)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("получены события %+v, ожидались %+v", got, tt.want)
+			}
+			for i := range got {
+				want := tt.want[i]
+				want.Time = at
+				if got[i] != want {
+					t.Errorf("событие %d: %+v, ожидалось %+v", i, got[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/metrics"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// timingRecorder собирает через httptrace моменты этапов обмена и адрес, с которым установлено соединение.
+// Если событие повторяется (например, несколько попыток подключения), учитывается первое
+type timingRecorder struct {
+	mu           sync.Mutex
+	upstream     net.Addr
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{start: time.Now()}
+}
+
+// withTrace добавляет в контекст трассировку, события которой записываются в recorder
+func (t *timingRecorder) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mark(&t.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mark(&t.dnsDone)
+		},
+		ConnectStart: func(string, string) {
+			t.mark(&t.connectStart)
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.mark(&t.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mark(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.mark(&t.tlsDone)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mark(&t.wroteRequest)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.upstream == nil {
+				t.upstream = info.Conn.RemoteAddr()
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+		},
+	})
+}
+
+func (t *timingRecorder) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+func (t *timingRecorder) upstreamAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.upstream
+}
+
+// timing возвращает разбивку обмена, который закончился в момент end (прочитан последний байт ответа)
+func (t *timingRecorder) timing(end time.Time) *entity.Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	firstByte := t.firstByte
+	if firstByte.IsZero() {
+		firstByte = end
+	}
+	return &entity.Timing{
+		DNS:      t.phase(t.dnsStart, t.dnsDone),
+		Connect:  t.phase(t.connectStart, t.connectDone),
+		TLS:      t.phase(t.tlsStart, t.tlsDone),
+		TTFB:     t.phase(t.wroteRequest, t.firstByte),
+		Transfer: t.phase(firstByte, end),
+		Total:    end.Sub(t.start),
+	}
+}
+
+func (t *timingRecorder) phase(from, to time.Time) entity.TimingPhase {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return entity.TimingPhase{}
+	}
+	return entity.TimingPhase{Start: from.Sub(t.start), Duration: to.Sub(from)}
+}
+
+// observeTiming учитывает этапы обмена в гистограмме длительности. Этапы, которых не было, не учитываются
+func observeTiming(timing *entity.Timing) {
+	phases := map[string]entity.TimingPhase{
+		"dns":      timing.DNS,
+		"connect":  timing.Connect,
+		"tls":      timing.TLS,
+		"ttfb":     timing.TTFB,
+		"transfer": timing.Transfer,
+	}
+	for name, phase := range phases {
+		if phase != (entity.TimingPhase{}) {
+			metrics.UpstreamDuration.WithLabelValues(name).Observe(phase.Duration.Seconds())
+		}
+	}
+	metrics.UpstreamDuration.WithLabelValues("total").Observe(timing.Total.Seconds())
+}
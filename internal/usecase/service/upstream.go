@@ -0,0 +1,350 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"slices"
+	"software.sslmate.com/src/go-pkcs12"
+	"sync"
+	"time"
+)
+
+type hostCertificate struct {
+	host string
+	cert tls.Certificate
+}
+
+type hostProxy struct {
+	host string
+	// nil означает прямое подключение
+	proxy *url.URL
+}
+
+type Upstream struct {
+	mu           sync.RWMutex
+	certificates []hostCertificate
+	proxies      []hostProxy
+	// клиент инструментов создаётся заново при каждой загрузке настроек: его пул соединений
+	// открыт по прежним правилам выбора прокси и с прежними клиентскими сертификатами
+	client   *http.Client
+	timeouts entity.Timeouts
+}
+
+// NewUpstreamUsecase загружает клиентские сертификаты и правила выбора вышестоящего прокси
+func NewUpstreamUsecase(settings entity.UpstreamSettings, timeouts entity.Timeouts) (usecase.UpstreamUsecase, error) {
+	u := &Upstream{timeouts: timeouts}
+	err := u.Reload(settings)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload заменяет клиентские сертификаты и правила выбора вышестоящего прокси. Если что-то из них не загрузилось,
+// остаются прежние. Уже начатые обмены не затрагиваются, а простаивающие соединения клиента инструментов закрываются
+func (u *Upstream) Reload(settings entity.UpstreamSettings) error {
+	certificates := make([]hostCertificate, 0)
+	var certs []entity.ClientCertificate
+	err := readJSONFile(settings.ClientCertsFile, &certs)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки клиентских сертификатов: %s", err)
+	}
+	for _, cfg := range append(slices.Clone(settings.ClientCerts), certs...) {
+		cert, err := loadClientCertificate(cfg)
+		if err != nil {
+			return fmt.Errorf("клиентский сертификат для %s: %s", cfg.Host, err)
+		}
+		certificates = append(certificates, hostCertificate{host: cfg.Host, cert: cert})
+	}
+
+	hostProxies := make([]hostProxy, 0)
+	var fileProxies []entity.UpstreamProxy
+	err = readJSONFile(settings.ProxiesFile, &fileProxies)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки вышестоящих прокси: %s", err)
+	}
+	proxies := append(slices.Clone(settings.Proxies), fileProxies...)
+	if settings.Proxy != "" {
+		proxies = append(proxies, entity.UpstreamProxy{URL: settings.Proxy})
+	}
+	for _, cfg := range proxies {
+		proxy, err := entity.ParseUpstreamProxy(cfg.URL)
+		if err != nil {
+			return fmt.Errorf("вышестоящий прокси для %q: %s", cfg.Host, err)
+		}
+		hostProxies = append(hostProxies, hostProxy{host: cfg.Host, proxy: proxy})
+	}
+
+	u.mu.Lock()
+	old := u.client
+	u.certificates, u.proxies = certificates, hostProxies
+	u.client = u.newHTTPClient()
+	u.mu.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// readJSONFile разбирает JSON-файл в v. Файл необязателен: пустое имя и отсутствие файла не считаются ошибкой
+func readJSONFile(filename string, v any) error {
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func loadClientCertificate(cfg entity.ClientCertificate) (tls.Certificate, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if cfg.PKCS12File == "" {
+		return tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	}
+
+	data, err := os.ReadFile(cfg.PKCS12File)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, cfg.Password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("ошибка разбора PKCS#12: %s", err)
+	}
+	// первым идёт сертификат клиента, за ним промежуточные: сервер проверяет по ним цепочку до своего корня
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, ca := range chain {
+		cert.Certificate = append(cert.Certificate, ca.Raw)
+	}
+	return cert, nil
+}
+
+// clientCertificate возвращает сертификат первого подходящего под хост правила
+func (u *Upstream) clientCertificate(host string) *tls.Certificate {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for i := range u.certificates {
+		if entity.MatchHostPattern(u.certificates[i].host, host) {
+			return &u.certificates[i].cert
+		}
+	}
+	return nil
+}
+
+// upstreamProxy возвращает вышестоящий прокси для хоста или nil, если подключаться нужно напрямую
+func (u *Upstream) upstreamProxy(host string) *url.URL {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, p := range u.proxies {
+		if entity.MatchHostPattern(p.host, host) {
+			return p.proxy
+		}
+	}
+	return nil
+}
+
+// Dial устанавливает TCP-соединение с addr напрямую или через вышестоящий прокси, выбранный по хосту
+func (u *Upstream) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := u.dialContext(ctx)
+	defer cancel()
+	var dialer net.Dialer
+	proxy := u.upstreamProxy(addr)
+	// к самому вышестоящему прокси, например, из клиента инструментов, подключаемся напрямую
+	if proxy == nil || proxy.Host == addr {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к вышестоящему прокси %s: %w", proxy.Host, err)
+	}
+	// рукопожатие с прокси должно укладываться в тот же дедлайн, что и само подключение
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = httpConnect(conn, addr, proxy.User)
+	} else {
+		err = socksConnect(conn, addr, proxy.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("вышестоящий прокси %s: %w", proxy.Host, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func (u *Upstream) DialHTTP(ctx context.Context, addr string) (net.Conn, *entity.ForwardProxy, error) {
+	proxy := u.forwardProxy(addr)
+	if proxy == nil {
+		conn, err := u.Dial(ctx, addr)
+		return conn, nil, err
+	}
+	ctx, cancel := u.dialContext(ctx)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка подключения к вышестоящему прокси %s: %w", proxy.Host, err)
+	}
+	return conn, &entity.ForwardProxy{Authorization: proxyAuthorization(proxy.User)}, nil
+}
+
+// forwardProxy возвращает вышестоящий HTTP-прокси для хоста или nil, если запрос без TLS отправляется не через него
+func (u *Upstream) forwardProxy(host string) *url.URL {
+	proxy := u.upstreamProxy(host)
+	if proxy == nil || proxy.Scheme != "http" {
+		return nil
+	}
+	return proxy
+}
+
+// proxyAuthorization возвращает значение Proxy-Authorization для учётных данных user или пустую строку
+func proxyAuthorization(user *url.Userinfo) string {
+	if user == nil {
+		return ""
+	}
+	password, _ := user.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+}
+
+// dialContext ограничивает подключение таймаутом Dial, если он задан
+func (u *Upstream) dialContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.timeouts.Dial <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, u.timeouts.Dial)
+}
+
+// httpConnect открывает туннель к addr через HTTP-прокси методом CONNECT. Так к серверу подключаются для TLS
+// и туннелей, а запросы без TLS прокси получает целиком (см. DialHTTP)
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if authorization := proxyAuthorization(user); authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT к %s отклонён: %s", addr, res.Status)
+	}
+	if reader.Buffered() > 0 {
+		// сервер успел что-то прислать вместе с ответом прокси - эти байты нельзя потерять
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// DialTLS устанавливает TLS-соединение с сервером и предъявляет клиентский сертификат, если он настроен для хоста.
+// Проверку сертификата сервера можно отключить для инструментов, которые работают с тестовыми стендами
+func (u *Upstream) DialTLS(ctx context.Context, addr, serverName string, verify bool) (*tls.Conn, error) {
+	// таймаут подключения распространяется и на TLS-рукопожатие
+	ctx, cancel := u.dialContext(ctx)
+	defer cancel()
+	conn, err := u.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !verify,
+	}
+	if cert := u.clientCertificate(serverName); cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	// http.Transport не видит рукопожатия внутри DialTLSContext, поэтому сообщаем о нём в трассировку сами
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// HTTPClient возвращает клиент для инструментов, которые сами отправляют запросы (repeat, param miner, сканер)
+func (u *Upstream) HTTPClient() *http.Client {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.client
+}
+
+func (u *Upstream) newHTTPClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// отключаем следование переадресации
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			// запросы без TLS HTTP-прокси получает целиком, а Proxy-Authorization транспорт добавляет сам.
+			// К остальным прокси подключается DialContext, иначе TLS не получил бы клиентский сертификат
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				if req.URL.Scheme != "http" {
+					return nil, nil
+				}
+				return u.forwardProxy(req.URL.Host), nil
+			},
+			ResponseHeaderTimeout: u.timeouts.ResponseHeader,
+			// соединения, вернувшиеся в пул заменённого клиента уже после Reload, закрываются по простою
+			IdleConnTimeout: 90 * time.Second,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return u.Dial(ctx, addr)
+			},
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				// отключаем проверку сертификатов
+				return u.DialTLS(ctx, addr, host, false)
+			},
+		},
+	}
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"testing"
+	"time"
+)
+
+func TestAbsoluteForm(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		authorization string
+		want          string
+	}{
+		{
+			name:          "путь и учётные данные",
+			raw:           "GET /a?b=%2f HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			authorization: "Basic dTpw",
+			want:          "GET http://example.com/a?b=%2f HTTP/1.1\r\nProxy-Authorization: Basic dTpw\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name: "без учётных данных и с LF",
+			raw:  "POST /form HTTP/1.1\nHost: example.com\nContent-Length: 3\n\na=1",
+			want: "POST http://example.com/form HTTP/1.1\nHost: example.com\nContent-Length: 3\n\na=1",
+		},
+		{
+			name: "цель уже в абсолютной форме",
+			raw:  "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			want: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(absoluteForm([]byte(tt.raw), "example.com", tt.authorization))
+			if got != tt.want {
+				t.Errorf("получено %q, ожидалось %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// forwardProxy принимает одно соединение, отвечает на запрос и передаёт его в requests
+func forwardProxy(t *testing.T) (addr string, requests <-chan *http.Request) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	ch := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		ch <- req
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+	return listener.Addr().String(), ch
+}
+
+func TestHTTPUpstreamProxyForwardsPlainHTTP(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(u *Upstream) error
+	}{
+		{
+			name: "запрос прокси",
+			send: func(u *Upstream) error {
+				conn, forward, err := u.DialHTTP(context.Background(), "example.com:80")
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				req, _ := http.NewRequest(http.MethodGet, "http://example.com/a?b=1", nil)
+				req.Header.Set("X-Client", "1")
+				_, err = Proxy{}.SendRequest(conn, req, forward)
+				if err == nil && req.Header.Get("Proxy-Authorization") != "" {
+					t.Error("учётные данные вышестоящего прокси попали в запрос клиента")
+				}
+				return err
+			},
+		},
+		{
+			name: "клиент инструментов",
+			send: func(u *Upstream) error {
+				res, err := u.HTTPClient().Get("http://example.com/a?b=1")
+				if err != nil {
+					return err
+				}
+				return res.Body.Close()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, requests := forwardProxy(t)
+			uc, err := NewUpstreamUsecase(entity.UpstreamSettings{Proxy: "http://user:pass@" + addr}, entity.Timeouts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.send(uc.(*Upstream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := <-requests
+			if req.Method == http.MethodConnect {
+				t.Fatal("запрос без TLS отправлен через CONNECT")
+			}
+			if req.RequestURI != "http://example.com/a?b=1" {
+				t.Errorf("цель запроса %q, ожидалась абсолютная форма", req.RequestURI)
+			}
+			if got := req.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpwYXNz" {
+				t.Errorf("Proxy-Authorization = %q", got)
+			}
+		})
+	}
+}
+
+// issue выпускает сертификат с именем name, подписанный parent (или самоподписанный, если parent nil)
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestLoadClientCertificatePKCS12(t *testing.T) {
+	ca, caKey := issue(t, "Промежуточный CA", nil, nil)
+	leaf, key := issue(t, "client", ca, caKey)
+	// современные контейнеры (PBES2 и AES) пакет golang.org/x/crypto/pkcs12 не разбирает
+	data, err := pkcs12.Modern.Encode(key, leaf, []*x509.Certificate{ca}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "client.p12")
+	err = os.WriteFile(filename, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := loadClientCertificate(entity.ClientCertificate{PKCS12File: filename, Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("в цепочке %d сертификатов, ожидалось 2", len(cert.Certificate))
+	}
+	if !cert.Leaf.Equal(leaf) || string(cert.Certificate[1]) != string(ca.Raw) {
+		t.Error("сертификат клиента должен идти первым, за ним промежуточный")
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("ключ %T, ожидался *ecdsa.PrivateKey", cert.PrivateKey)
+	}
+}
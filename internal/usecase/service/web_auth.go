@@ -0,0 +1,134 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"github.com/blackHATred/mitm_proxy/internal/usecase"
+	"sync"
+	"time"
+)
+
+const sessionTTL = 12 * time.Hour
+
+// maxSessions ограничивает число сессий в памяти: при превышении вытесняются те, что истекают раньше
+const maxSessions = 10000
+
+type WebAuth struct {
+	mu       sync.Mutex
+	users    map[string]string
+	token    string
+	sessions map[string]*entity.Session
+}
+
+// NewWebAuthUsecase настраивает вход в веб-интерфейс по локальным пользователям (файл и список строк user:password)
+// и/или по статическому токену. Если не задано ни то, ни другое, вход не требуется
+func NewWebAuthUsecase(filename string, users []string, token string) (usecase.WebAuthUsecase, error) {
+	credentials, err := loadCredentials(filename, users)
+	if err != nil {
+		return nil, fmt.Errorf("пользователи веб-интерфейса: %s", err)
+	}
+	return &WebAuth{
+		users:    credentials,
+		token:    token,
+		sessions: make(map[string]*entity.Session),
+	}, nil
+}
+
+func (a *WebAuth) Enabled() bool {
+	return len(a.users) > 0 || a.token != ""
+}
+
+func (a *WebAuth) Login(username, password string) (*entity.Session, error) {
+	expected, ok := a.users[username]
+	if !ok || !checkPassword(expected, password) {
+		return nil, usecase.ErrInvalidCredentials
+	}
+	return a.newSession(username)
+}
+
+func (a *WebAuth) LoginToken(token string) (*entity.Session, error) {
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(a.token), []byte(token)) != 1 {
+		return nil, usecase.ErrInvalidCredentials
+	}
+	return a.newSession("token")
+}
+
+// AnonymousSession выдаёт сессию без входа, когда аутентификация отключена: она нужна, чтобы хранить CSRF-токен
+func (a *WebAuth) AnonymousSession() (*entity.Session, error) {
+	if a.Enabled() {
+		return nil, errors.New("аутентификация включена, анонимная сессия недоступна")
+	}
+	return a.newSession("")
+}
+
+func (a *WebAuth) Session(id string) (*entity.Session, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	session, ok := a.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(session.Expires) {
+		delete(a.sessions, id)
+		return nil, false
+	}
+	return session, true
+}
+
+func (a *WebAuth) Logout(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, id)
+}
+
+func (a *WebAuth) newSession(user string) (*entity.Session, error) {
+	id, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	session := &entity.Session{
+		ID:        id,
+		User:      user,
+		CSRFToken: csrf,
+		Expires:   time.Now().Add(sessionTTL),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// заодно выбрасываем истёкшие сессии, чтобы они не копились
+	for key, s := range a.sessions {
+		if time.Now().After(s.Expires) {
+			delete(a.sessions, key)
+		}
+	}
+	for len(a.sessions) >= maxSessions {
+		oldest := ""
+		for key, s := range a.sessions {
+			if oldest == "" || s.Expires.Before(a.sessions[oldest].Expires) {
+				oldest = key
+			}
+		}
+		delete(a.sessions, oldest)
+	}
+	a.sessions[id] = session
+	return session, nil
+}
+
+// newToken генерирует случайный токен для идентификатора сессии и CSRF: math/rand здесь не годится
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
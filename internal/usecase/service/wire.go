@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wireReader читает запросы клиента и запоминает прочитанные байты, чтобы сохранить запрос в том виде,
+// в котором он пришёл: с исходными строкой запроса, регистром и порядком заголовков и chunked-кодированием
+type wireReader struct {
+	*bufio.Reader
+	tap bytes.Buffer
+}
+
+// newWireReader создаёт reader поверх src. Если часть потока уже вычитана в prev (например, при определении
+// протокола), эти байты читаются первыми, а сам prev больше использовать нельзя
+func newWireReader(src io.Reader, prev *bufio.Reader) *wireReader {
+	if prev != nil && prev.Buffered() > 0 {
+		buffered, _ := prev.Peek(prev.Buffered())
+		src = io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), src)
+	}
+	r := &wireReader{}
+	r.Reader = bufio.NewReader(io.TeeReader(src, &r.tap))
+	return r
+}
+
+// take возвращает байты текущего запроса. Байты, которые reader успел прочитать наперёд,
+// относятся к следующему запросу и остаются до следующего вызова
+func (r *wireReader) take() []byte {
+	data := r.tap.Bytes()
+	n := len(data) - r.Buffered()
+	raw := bytes.Clone(data[:n])
+	rest := bytes.Clone(data[n:])
+	r.tap.Reset()
+	r.tap.Write(rest)
+	return raw
+}
+
+// buffered возвращает байты, которые reader прочитал из соединения наперёд, но ещё не отдал
+func (r *wireReader) buffered() []byte {
+	data, _ := r.Peek(r.Buffered())
+	return bytes.Clone(data)
+}
+
+type wireReaderKey struct{}
+
+// wireRequest дочитывает тело запроса и возвращает запрос в исходном виде.
+// Для запросов, прочитанных не через wireReader, возвращает nil
+func wireRequest(req *http.Request) ([]byte, error) {
+	reader, ok := req.Context().Value(wireReaderKey{}).(*wireReader)
+	if !ok {
+		return nil, nil
+	}
+	_, err := peekBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return stripProxyHeaders(reader.take()), nil
+}
+
+// proxyHeaders - заголовки, адресованные самому прокси. В сохранённый запрос они не попадают:
+// иначе учётные данные прокси видны в истории и уходят на сервер при повторе исходных байтов
+var proxyHeaders = []string{"Proxy-Authorization", "Proxy-Connection"}
+
+// stripProxyHeaders убирает из исходного запроса строки заголовков proxyHeaders вместе с их продолжениями
+// (obs-fold), не трогая остальные байты
+func stripProxyHeaders(raw []byte) []byte {
+	// end указывает на пустую строку после заголовков, строки заголовков остаются со своими переводами строк
+	end := len(raw)
+	if crlf := bytes.Index(raw, []byte("\r\n\r\n")); crlf >= 0 {
+		end = crlf + 2
+	}
+	if lf := bytes.Index(raw, []byte("\n\n")); lf >= 0 && lf+1 < end {
+		end = lf + 1
+	}
+	result := make([]byte, 0, len(raw))
+	dropping := false
+	for i, line := range bytes.SplitAfter(raw[:end], []byte("\n")) {
+		if i > 0 {
+			if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+				if dropping {
+					continue
+				}
+			} else {
+				name, _, _ := bytes.Cut(line, []byte(":"))
+				dropping = isProxyHeader(string(bytes.TrimSpace(name)))
+				if dropping {
+					continue
+				}
+			}
+		}
+		result = append(result, line...)
+	}
+	return append(result, raw[end:]...)
+}
+
+// absoluteForm переписывает цель в строке запроса raw в абсолютную форму с хостом host для вышестоящего HTTP-прокси
+// и добавляет за этой строкой Proxy-Authorization, если authorization не пуст. Остальные байты запроса не меняются
+func absoluteForm(raw []byte, host, authorization string) []byte {
+	lineEnd := bytes.IndexByte(raw, '\n')
+	if lineEnd < 0 {
+		return raw
+	}
+	line := bytes.TrimRight(raw[:lineEnd], "\r")
+	eol := raw[len(line) : lineEnd+1]
+	method, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return raw
+	}
+	result := make([]byte, 0, len(raw)+len(host)+len(authorization)+32)
+	result = append(result, method...)
+	result = append(result, ' ')
+	if bytes.HasPrefix(rest, []byte("/")) {
+		result = append(result, "http://"+host...)
+	}
+	result = append(result, rest...)
+	result = append(result, eol...)
+	if authorization != "" {
+		result = append(result, "Proxy-Authorization: "+authorization...)
+		result = append(result, eol...)
+	}
+	return append(result, raw[lineEnd+1:]...)
+}
+
+func isProxyHeader(name string) bool {
+	for _, header := range proxyHeaders {
+		if strings.EqualFold(name, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxWireCapture ограничивает запоминаемый ответ сервера. Больший ответ сохраняется в историю только в разобранном виде
+const maxWireCapture = 8 << 20
+
+// wireConn запоминает байты, прочитанные из соединения с сервером, но не больше maxWireCapture
+type wireConn struct {
+	net.Conn
+	tap bytes.Buffer
+	// ответ не поместился в maxWireCapture или запоминание отключено через detach
+	stopped bool
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped {
+		if c.tap.Len()+n > maxWireCapture {
+			c.detach()
+		} else {
+			c.tap.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// detach прекращает запоминание и освобождает буфер, например перед пересылкой бесконечного потока событий
+func (c *wireConn) detach() {
+	c.stopped = true
+	c.tap = bytes.Buffer{}
+}
+
+// captured возвращает прочитанные байты или nil, если запоминание было прекращено
+func (c *wireConn) captured() []byte {
+	if c.stopped {
+		return nil
+	}
+	return c.tap.Bytes()
+}
@@ -0,0 +1,51 @@
+package service
+
+import "testing"
+
+func TestStripProxyHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "учётные данные прокси",
+			raw:  "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic dTpw\r\nAccept: */*\r\n\r\n",
+			want: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name: "регистр имени и пробелы",
+			raw:  "GET / HTTP/1.1\r\nproxy-connection : keep-alive\r\nHost: example.com\r\n\r\n",
+			want: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name: "продолжение заголовка (obs-fold)",
+			raw:  "GET / HTTP/1.1\r\nProxy-Authorization: Basic\r\n dTpw\r\nX-Folded: a\r\n b\r\n\r\n",
+			want: "GET / HTTP/1.1\r\nX-Folded: a\r\n b\r\n\r\n",
+		},
+		{
+			name: "тело не меняется",
+			raw:  "POST / HTTP/1.1\r\nProxy-Connection: close\r\nContent-Length: 27\r\n\r\nProxy-Authorization: secret",
+			want: "POST / HTTP/1.1\r\nContent-Length: 27\r\n\r\nProxy-Authorization: secret",
+		},
+		{
+			name: "переводы строк LF",
+			raw:  "GET / HTTP/1.1\nProxy-Authorization: Basic dTpw\nHost: example.com\n\nbody",
+			want: "GET / HTTP/1.1\nHost: example.com\n\nbody",
+		},
+		{
+			name: "без заголовков прокси",
+			raw:  "GET / HTTP/1.1\r\nHost: example.com\r\nX-Proxy-Authorization: keep\r\n\r\n",
+			want: "GET / HTTP/1.1\r\nHost: example.com\r\nX-Proxy-Authorization: keep\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(stripProxyHeaders([]byte(tt.raw)))
+			if got != tt.want {
+				t.Errorf("получено %q, ожидалось %q", got, tt.want)
+			}
+		})
+	}
+}
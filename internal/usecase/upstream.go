@@ -0,0 +1,20 @@
+package usecase
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+	"net"
+	"net/http"
+)
+
+type UpstreamUsecase interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// DialHTTP подключается для отправки запроса без TLS к addr. Если для хоста выбран HTTP-прокси, возвращается
+	// соединение с ним и непустой forward: запрос нужно отправить прокси в абсолютной форме
+	DialHTTP(ctx context.Context, addr string) (conn net.Conn, forward *entity.ForwardProxy, err error)
+	DialTLS(ctx context.Context, addr, serverName string, verify bool) (*tls.Conn, error)
+	HTTPClient() *http.Client
+	// Reload заменяет клиентские сертификаты и правила выбора вышестоящего прокси, файлы из settings перечитываются
+	Reload(settings entity.UpstreamSettings) error
+}
@@ -0,0 +1,18 @@
+package usecase
+
+import (
+	"errors"
+	"github.com/blackHATred/mitm_proxy/internal/entity"
+)
+
+// ErrInvalidCredentials - неверный логин, пароль или токен при входе в веб-интерфейс
+var ErrInvalidCredentials = errors.New("неверные учётные данные")
+
+type WebAuthUsecase interface {
+	Enabled() bool
+	Login(username, password string) (*entity.Session, error)
+	LoginToken(token string) (*entity.Session, error)
+	AnonymousSession() (*entity.Session, error)
+	Session(id string) (*entity.Session, bool)
+	Logout(id string)
+}